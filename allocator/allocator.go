@@ -34,6 +34,7 @@ func FormatAllocator(blk []byte, u uuid.UUID) error {
 	aloc := OpenAllocator(blk)
 
 	aloc.setBit(0)
+	aloc.setInUse(1)
 
 	return nil
 }
@@ -52,6 +53,15 @@ func (a *Allocator) SetFlags(flags uint16) {
 	binary.PutUint16(a.blk[flagsStart:flagsEnd], flags)
 }
 
+// InUse returns number of blocks in use, including the allocator block itself
+func (a *Allocator) InUse() uint {
+	return uint(binary.Uint32(a.blk[inUseStart:inUseEnd]))
+}
+
+func (a *Allocator) setInUse(n uint) {
+	binary.PutUint32(a.blk[inUseStart:inUseEnd], uint32(n))
+}
+
 func (a *Allocator) IsFull() bool {
 	return a.Flags()&flagFull != 0
 }
@@ -60,6 +70,10 @@ func (a *Allocator) setFull() {
 	a.SetFlags(a.Flags() | flagFull)
 }
 
+func (a *Allocator) IsFragmented() bool {
+	return a.Flags()&flagFragmented != 0
+}
+
 func (a *Allocator) ResetTip() {
 	a.tip = 0
 }
@@ -100,37 +114,153 @@ func (a *Allocator) clearBit(i uint) {
 	a.bitfield[ix] &^= (1 << pos)
 }
 
+// IsUsed reports whether i-th block is marked as used
+func (a *Allocator) IsUsed(i uint) bool {
+	return a.getBit(i)
+}
+
+// Check verifies consistency of the header with the bitfield
+func (a *Allocator) Check() error {
+	if a.Flags()&reservedMask != 0 {
+		return errors.Trace(ErrFlagsReserved)
+	}
+	if !a.getBit(0) {
+		return errors.Trace(ErrHeaderNotUsed)
+	}
+
+	var n uint
+	for i := uint(0); i < BlocksPerAllocator; i++ {
+		if a.getBit(i) {
+			n++
+		}
+	}
+	if n != a.InUse() {
+		return errors.Trace(ErrInUseMissMatch)
+	}
+
+	if a.freeCnt() > FreeListLength {
+		return errors.Trace(ErrFreeListInvalid)
+	}
+	for i := uint(0); i < a.freeCnt(); i++ {
+		r := a.freeRangeAt(i)
+		if err := a.checkRange(r.start, r.end); err != nil {
+			return errors.Trace(ErrFreeListInvalid)
+		}
+		for b := r.start; b <= r.end; b++ {
+			if a.getBit(b) {
+				return errors.Trace(ErrFreeListInvalid)
+			}
+		}
+	}
+	return nil
+}
+
+// Reset marks all blocks except the allocator itself as free and clears the
+// free list, used to rebuild the bitfield from scratch
+func (a *Allocator) Reset() {
+	for i := range a.bitfield {
+		a.bitfield[i] = 0
+	}
+	a.clearFreeList()
+	a.SetFlags(0)
+	a.setBit(0)
+	a.setInUse(1)
+	a.tip = 0
+}
+
+// Allocate allocates count contiguous blocks and returns the first and the last
+// of them. ErrOutOfSpace is returned if there is no free run long enough, the
+// allocator is marked as full only once all its blocks are used.
 func (a *Allocator) Allocate(count uint) (uint, uint, error) {
+	return a.allocate(count, true)
+}
+
+// AllocateUpTo allocates the first free run of at most count blocks. Unlike
+// Allocate it makes use of holes shorter than count left after Free and fails
+// only if there are no free blocks left.
+func (a *Allocator) AllocateUpTo(count uint) (uint, uint, error) {
+	return a.allocate(count, false)
+}
+
+// skipUsed moves tip to the next free block
+func (a *Allocator) skipUsed() error {
+	// Skip by a byte at a time
+	for a.bitfield[a.tip/8] == 0xff {
+		if err := a.incTipByByte(); err != nil {
+			return err
+		}
+	}
+
+	for a.getBit(a.tip) {
+		if err := a.incTip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Allocator) allocate(count uint, exact bool) (uint, uint, error) {
+	if count == 0 || count >= BlocksPerAllocator {
+		return 0, 0, errors.Trace(ErrInvalidRange)
+	}
 	if a.IsFull() {
 		return 0, 0, errors.Trace(ErrOutOfSpace)
 	}
+	if a.InUse() >= BlocksPerAllocator {
+		a.setFull()
+		return 0, 0, errors.Trace(ErrOutOfSpace)
+	}
+	if exact && a.InUse()+count > BlocksPerAllocator {
+		return 0, 0, errors.Trace(ErrOutOfSpace)
+	}
 
-outer:
-	for {
-		var start, end uint
-		// Skip by a byte at a time
-		for a.bitfield[a.tip/8] == 0xff {
-			if err := a.incTipByByte(); err != nil {
+	if start, end, ok := a.takeFree(count, exact); ok {
+		a.setInUse(a.InUse() + end - start + 1)
+		return start, end, nil
+	}
+
+	// blocks before the tip are scanned once more before giving up,
+	// freed runs or ones too short for earlier allocations live there
+	wrapped := a.tip == 0
+	outOfSpace := func(err error) error {
+		if wrapped {
+			// holes shorter than count may remain for AllocateUpTo
+			if a.InUse() >= BlocksPerAllocator {
 				a.setFull()
-				return 0, 0, errors.Trace(err)
 			}
+			return errors.Trace(err)
 		}
+		a.tip = 0
+		wrapped = true
+		return nil
+	}
 
-		for a.getBit(a.tip) {
-			if err := a.incTip(); err != nil {
-				a.setFull()
-				return 0, 0, errors.Trace(err)
+outer:
+	for {
+		var start, end uint
+		if err := a.skipUsed(); err != nil {
+			if err := outOfSpace(err); err != nil {
+				return 0, 0, err
 			}
+			continue outer
 		}
 		start = a.tip
 		end = start
 
 		for end-start+1 != count {
 			if err := a.incTip(); err != nil {
-				a.setFull()
-				return 0, 0, errors.Trace(err)
+				if !exact {
+					break
+				}
+				if err := outOfSpace(err); err != nil {
+					return 0, 0, err
+				}
+				continue outer
 			}
 			if a.getBit(a.tip) {
+				if !exact {
+					break
+				}
 				continue outer
 			}
 			end = a.tip
@@ -139,7 +269,83 @@ outer:
 		for i := uint(start); i <= end; i++ {
 			a.setBit(i)
 		}
+		a.setInUse(a.InUse() + end - start + 1)
+		a.dropFree(start, end)
 		return start, end, nil
 	}
+}
+
+func (a *Allocator) checkRange(start, end uint) error {
+	if start == 0 || start > end || end >= BlocksPerAllocator {
+		return errors.Trace(ErrInvalidRange)
+	}
+	return nil
+}
+
+// Reserve marks blocks in range [start, end] as used
+func (a *Allocator) Reserve(start, end uint) error {
+	if err := a.checkRange(start, end); err != nil {
+		return err
+	}
+
+	n := a.InUse()
+	for i := start; i <= end; i++ {
+		if !a.getBit(i) {
+			a.setBit(i)
+			n++
+		}
+	}
+	a.setInUse(n)
+	a.dropFree(start, end)
+	return nil
+}
+
+// Free marks blocks in range [start, end] as no longer used. All of them have
+// to be allocated. Freed range is put on the free list and reused by following
+// allocations, if the list is full it will be found by scanning the bitfield.
+func (a *Allocator) Free(start, end uint) error {
+	if err := a.checkRange(start, end); err != nil {
+		return err
+	}
+
+	for i := start; i <= end; i++ {
+		if !a.getBit(i) {
+			return errors.Trace(ErrNotAllocated)
+		}
+	}
+
+	for i := start; i <= end; i++ {
+		a.clearBit(i)
+	}
+	a.setInUse(a.InUse() - (end - start + 1))
+
+	flags := a.Flags() &^ flagFull
+	switch {
+	case a.InUse() == 1:
+		flags &^= flagFragmented | flagFreeListOverflow
+		a.setFreeCnt(0)
+	case a.usedAfter(end):
+		flags |= flagFragmented
+	}
+	a.SetFlags(flags)
 
+	if a.InUse() != 1 && !a.pushFree(start, end) {
+		a.overflow(start)
+	}
+	return nil
+}
+
+// usedAfter reports whether any block after i is in use
+func (a *Allocator) usedAfter(i uint) bool {
+	for i++; i < BlocksPerAllocator && i%8 != 0; i++ {
+		if a.getBit(i) {
+			return true
+		}
+	}
+	for ix := i / 8; ix < uint(len(a.bitfield)); ix++ {
+		if a.bitfield[ix] != 0 {
+			return true
+		}
+	}
+	return false
 }
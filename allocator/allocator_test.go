@@ -1,6 +1,7 @@
 package allocator
 
 import (
+	"math/rand"
 	"testing"
 
 	"github.com/ipfs/go-sbs/consts"
@@ -29,6 +30,12 @@ func TestUUID(t *testing.T) {
 	assert.NoError(t, err, "Format should not error")
 }
 
+func TestHeaderLayout(t *testing.T) {
+	// positions of allocators in existing volumes depend on these
+	assert.EqualValues(t, 32, AllocatorHeaderSize, "header size changed")
+	assert.EqualValues(t, 65280, BlocksPerAllocator, "blocks per allocator changed")
+}
+
 func TestIncTip(t *testing.T) {
 	_, a := makeAlloc()
 
@@ -137,11 +144,35 @@ func TestAlmostFull(t *testing.T) {
 	_, _, err = a.Allocate(100)
 	assert.EqualError(t, err, ErrOutOfSpace.Error(),
 		"big allocation should cause error")
+	assert.False(t, a.IsFull(), "allocator with free blocks is not full")
+
+	_, _, err = a.Allocate(9)
+	assert.NoError(t, err, "remaining blocks should be allocated")
+	_, _, err = a.Allocate(1)
+	assert.EqualError(t, err, ErrOutOfSpace.Error(), "should be out of space")
 
 	assert.True(t, a.IsFull(), "allocator should be marked as full")
 	assert.True(t, a.Flags()&flagFull != 0, "flag in serialized form is set")
 }
 
+func TestFragmentedNotFull(t *testing.T) {
+	_, a := makeAlloc()
+
+	_, _, err := a.Allocate(BlocksPerAllocator - 1)
+	assert.NoError(t, err, "should not error")
+	for b := uint(100); b < 200; b += 2 {
+		assert.NoError(t, a.Free(b, b), "should not error")
+	}
+
+	_, _, err = a.Allocate(2)
+	assert.EqualError(t, err, ErrOutOfSpace.Error(), "no run of two blocks")
+	assert.False(t, a.IsFull(), "holes are left")
+
+	start, stop, err := a.AllocateUpTo(2)
+	assert.NoError(t, err, "holes should be used")
+	assert.Equal(t, start, stop, "holes are one block long")
+}
+
 func TestFragmented(t *testing.T) {
 	_, a := makeAlloc()
 
@@ -152,3 +183,372 @@ func TestFragmented(t *testing.T) {
 	assert.EqualValues(t, 3, start, "start should be after last set")
 	assert.EqualValues(t, 4, stop, "stop should be one bigger than start")
 }
+
+func TestReserveAndFree(t *testing.T) {
+	_, a := makeAlloc()
+
+	err := a.Reserve(1, 3)
+	assert.NoError(t, err, "reserve should not error")
+	for i := uint(1); i <= 3; i++ {
+		assert.True(t, a.getBit(i), "reserved block should be marked")
+	}
+
+	start, stop, err := a.Allocate(1)
+	assert.NoError(t, err, "should not error")
+	assert.EqualValues(t, 4, start, "should skip reserved blocks")
+	assert.EqualValues(t, 4, stop, "should skip reserved blocks")
+
+	err = a.Free(2, 3)
+	assert.NoError(t, err, "free should not error")
+	assert.True(t, a.getBit(1), "block outside freed range stays marked")
+	assert.False(t, a.getBit(2), "freed block should be cleared")
+	assert.False(t, a.getBit(3), "freed block should be cleared")
+}
+
+func TestInvalidRange(t *testing.T) {
+	_, a := makeAlloc()
+
+	err := a.Free(0, 1)
+	assert.EqualError(t, err, ErrInvalidRange.Error(), "header can't be freed")
+	err = a.Reserve(3, 2)
+	assert.EqualError(t, err, ErrInvalidRange.Error(), "end before start")
+	err = a.Free(1, BlocksPerAllocator)
+	assert.EqualError(t, err, ErrInvalidRange.Error(), "end past allocator")
+	assert.True(t, a.getBit(0), "header should stay marked")
+}
+
+func TestInUse(t *testing.T) {
+	_, a := makeAlloc()
+	assert.EqualValues(t, 1, a.InUse(), "allocator block itself is in use")
+
+	_, _, err := a.Allocate(10)
+	assert.NoError(t, err, "should not error")
+	assert.EqualValues(t, 11, a.InUse(), "allocated blocks are counted")
+
+	err = a.Reserve(5, 20)
+	assert.NoError(t, err, "should not error")
+	assert.EqualValues(t, 21, a.InUse(), "only newly reserved are counted")
+
+	err = a.Free(1, 4)
+	assert.NoError(t, err, "should not error")
+	assert.EqualValues(t, 17, a.InUse(), "freed blocks are not counted")
+}
+
+func TestFreeReuse(t *testing.T) {
+	_, a := makeAlloc()
+
+	_, _, err := a.Allocate(10)
+	assert.NoError(t, err, "should not error")
+
+	err = a.Free(3, 5)
+	assert.NoError(t, err, "should not error")
+	assert.True(t, a.IsFragmented(), "hole should mark allocator fragmented")
+
+	start, stop, err := a.Allocate(3)
+	assert.NoError(t, err, "should not error")
+	assert.EqualValues(t, 3, start, "freed space should be reused")
+	assert.EqualValues(t, 5, stop, "freed space should be reused")
+
+	err = a.Free(1, 10)
+	assert.NoError(t, err, "should not error")
+	assert.False(t, a.IsFragmented(), "empty allocator is not fragmented")
+}
+
+func TestFreeTail(t *testing.T) {
+	_, a := makeAlloc()
+
+	_, _, err := a.Allocate(10)
+	assert.NoError(t, err, "should not error")
+
+	err = a.Free(8, 10)
+	assert.NoError(t, err, "should not error")
+	assert.False(t, a.IsFragmented(), "freeing the tail leaves no hole")
+}
+
+func TestFreeFull(t *testing.T) {
+	_, a := makeAlloc()
+
+	_, _, err := a.Allocate(BlocksPerAllocator - 1)
+	assert.NoError(t, err, "should not error")
+	_, _, err = a.Allocate(1)
+	assert.EqualError(t, err, ErrOutOfSpace.Error(), "should be full")
+	assert.True(t, a.IsFull(), "should be full")
+
+	err = a.Free(100, 100)
+	assert.NoError(t, err, "should not error")
+	assert.False(t, a.IsFull(), "free should clear full flag")
+
+	start, stop, err := a.Allocate(1)
+	assert.NoError(t, err, "should not error")
+	assert.EqualValues(t, 100, start, "freed block should be reused")
+	assert.EqualValues(t, 100, stop, "freed block should be reused")
+}
+
+func TestDoubleFree(t *testing.T) {
+	_, a := makeAlloc()
+
+	_, _, err := a.Allocate(4)
+	assert.NoError(t, err, "should not error")
+
+	err = a.Free(2, 2)
+	assert.NoError(t, err, "should not error")
+	err = a.Free(1, 3)
+	assert.EqualError(t, err, ErrNotAllocated.Error(), "double free should error")
+	assert.True(t, a.getBit(1), "failed free should not modify allocator")
+	assert.EqualValues(t, 4, a.InUse(), "failed free should not modify counter")
+}
+
+func TestWrapAround(t *testing.T) {
+	_, a := makeAlloc()
+
+	_, _, err := a.Allocate(BlocksPerAllocator - 1)
+	assert.NoError(t, err, "should not error")
+
+	a.clearBit(10)
+	a.clearBit(11)
+	a.setInUse(a.InUse() - 2)
+
+	start, stop, err := a.Allocate(2)
+	assert.NoError(t, err, "should find run before the tip")
+	assert.EqualValues(t, 10, start, "should allocate the hole")
+	assert.EqualValues(t, 11, stop, "should allocate the hole")
+	assert.False(t, a.IsFull(), "allocator was not full")
+}
+
+func TestAllocateUpTo(t *testing.T) {
+	_, a := makeAlloc()
+
+	_, _, err := a.Allocate(20)
+	assert.NoError(t, err, "should not error")
+	assert.NoError(t, a.Free(3, 4), "should not error")
+	assert.NoError(t, a.Free(10, 12), "should not error")
+
+	start, stop, err := a.Allocate(4)
+	assert.NoError(t, err, "should not error")
+	assert.EqualValues(t, 21, start, "exact allocation skips short holes")
+	assert.EqualValues(t, 24, stop, "exact allocation skips short holes")
+
+	a.ResetTip()
+	start, stop, err = a.AllocateUpTo(4)
+	assert.NoError(t, err, "should not error")
+	assert.EqualValues(t, 3, start, "should use the first hole")
+	assert.EqualValues(t, 4, stop, "should stop at end of the hole")
+
+	start, stop, err = a.AllocateUpTo(2)
+	assert.NoError(t, err, "should not error")
+	assert.EqualValues(t, 10, start, "should use the second hole")
+	assert.EqualValues(t, 11, stop, "should allocate at most count")
+}
+
+func TestAllocateUpToFull(t *testing.T) {
+	_, a := makeAlloc()
+
+	_, _, err := a.Allocate(BlocksPerAllocator - 10)
+	assert.NoError(t, err, "should not error")
+
+	start, stop, err := a.AllocateUpTo(100)
+	assert.NoError(t, err, "remaining blocks should be allocated")
+	assert.EqualValues(t, BlocksPerAllocator-9, start, "should start after last")
+	assert.EqualValues(t, BlocksPerAllocator-1, stop, "should end at the end")
+
+	_, _, err = a.AllocateUpTo(1)
+	assert.EqualError(t, err, ErrOutOfSpace.Error(), "should be full")
+	assert.True(t, a.IsFull(), "should be full")
+}
+
+func TestAllocateInvalidCount(t *testing.T) {
+	_, a := makeAlloc()
+
+	_, _, err := a.Allocate(0)
+	assert.EqualError(t, err, ErrInvalidRange.Error(), "zero blocks")
+	_, _, err = a.AllocateUpTo(BlocksPerAllocator)
+	assert.EqualError(t, err, ErrInvalidRange.Error(), "more than allocator")
+}
+
+func TestRandomAllocFree(t *testing.T) {
+	_, a := makeAlloc()
+	r := rand.New(rand.NewSource(42))
+
+	used := make(map[uint]bool)
+	type run struct{ start, end uint }
+	var runs []run
+
+	for i := 0; i < 5000; i++ {
+		if len(runs) != 0 && r.Intn(3) == 0 {
+			j := r.Intn(len(runs))
+			rn := runs[j]
+			runs = append(runs[:j], runs[j+1:]...)
+
+			assert.NoError(t, a.Free(rn.start, rn.end), "free should not error")
+			for b := rn.start; b <= rn.end; b++ {
+				delete(used, b)
+			}
+			continue
+		}
+
+		count := uint(r.Intn(64) + 1)
+		var start, end uint
+		var err error
+		if r.Intn(2) == 0 {
+			start, end, err = a.Allocate(count)
+		} else {
+			start, end, err = a.AllocateUpTo(count)
+		}
+		if err != nil {
+			continue
+		}
+		for b := start; b <= end; b++ {
+			if used[b] {
+				t.Fatalf("block %d allocated twice", b)
+			}
+			used[b] = true
+		}
+		runs = append(runs, run{start, end})
+	}
+
+	assert.EqualValues(t, len(used)+1, a.InUse(), "in use counter should match")
+	assert.NoError(t, a.Check(), "allocator should be consistent")
+}
+
+func TestFreeList(t *testing.T) {
+	_, a := makeAlloc()
+
+	_, _, err := a.Allocate(100)
+	assert.NoError(t, err, "should not error")
+
+	assert.NoError(t, a.Free(10, 19), "should not error")
+	assert.NoError(t, a.Free(20, 24), "should not error")
+	assert.NoError(t, a.Free(50, 52), "should not error")
+	assert.Equal(t, [][2]uint{{10, 24}, {50, 52}}, a.FreeRanges(),
+		"adjacent ranges should be merged")
+
+	a2 := OpenAllocator(a.blk)
+	assert.Equal(t, a.FreeRanges(), a2.FreeRanges(), "free list is persisted")
+
+	start, stop, err := a2.Allocate(3)
+	assert.NoError(t, err, "should not error")
+	assert.EqualValues(t, 10, start, "should take from free list")
+	assert.EqualValues(t, 12, stop, "should take from free list")
+	assert.Equal(t, [][2]uint{{13, 24}, {50, 52}}, a2.FreeRanges(),
+		"entry should be shrunk")
+
+	start, stop, err = a2.Allocate(12)
+	assert.NoError(t, err, "should not error")
+	assert.EqualValues(t, 13, start, "should take whole entry")
+	assert.EqualValues(t, 24, stop, "should take whole entry")
+	assert.Equal(t, [][2]uint{{50, 52}}, a2.FreeRanges(),
+		"used up entry should be removed")
+}
+
+func TestFreeListOverflow(t *testing.T) {
+	_, a := makeAlloc()
+
+	_, _, err := a.Allocate(200)
+	assert.NoError(t, err, "should not error")
+
+	for i := uint(0); i < FreeListLength+2; i++ {
+		b := 2 + i*4
+		assert.NoError(t, a.Free(b, b), "should not error")
+	}
+	assert.Len(t, a.FreeRanges(), FreeListLength, "list should be full")
+	assert.True(t, a.Flags()&flagFreeListOverflow != 0, "overflow should be marked")
+
+	seen := make(map[uint]bool)
+	for i := uint(0); i < FreeListLength+2; i++ {
+		start, stop, err := a.Allocate(1)
+		assert.NoError(t, err, "should not error")
+		assert.Equal(t, start, stop, "single block")
+		assert.EqualValues(t, 2, start%4, "freed blocks should be reused")
+		assert.False(t, seen[start], "block should not be reused twice")
+		seen[start] = true
+	}
+
+	start, _, err := a.Allocate(1)
+	assert.NoError(t, err, "should not error")
+	assert.EqualValues(t, 201, start, "after holes allocation continues at end")
+}
+
+func TestReserveTrimsFreeList(t *testing.T) {
+	_, a := makeAlloc()
+
+	_, _, err := a.Allocate(20)
+	assert.NoError(t, err, "should not error")
+	assert.NoError(t, a.Free(5, 15), "should not error")
+
+	assert.NoError(t, a.Reserve(9, 10), "should not error")
+	assert.Equal(t, [][2]uint{{5, 8}, {11, 15}}, a.FreeRanges(),
+		"reserved blocks should be removed from the list")
+
+	assert.NoError(t, a.Reserve(3, 6), "should not error")
+	assert.Equal(t, [][2]uint{{7, 8}, {11, 15}}, a.FreeRanges(),
+		"overlapping entry should be trimmed")
+}
+
+func TestReset(t *testing.T) {
+	_, a := makeAlloc()
+
+	_, _, err := a.Allocate(20)
+	assert.NoError(t, err, "should not error")
+	assert.NoError(t, a.Free(5, 15), "should not error")
+	assert.True(t, a.IsFragmented(), "should be fragmented")
+
+	a.Reset()
+	assert.EqualValues(t, 1, a.InUse(), "only allocator block should be in use")
+	assert.True(t, a.IsUsed(0), "allocator block should stay used")
+	assert.False(t, a.IsUsed(1), "blocks should be free")
+	assert.Empty(t, a.FreeRanges(), "free list should be cleared")
+	assert.False(t, a.IsFragmented(), "flags should be cleared")
+
+	start, end, err := a.Allocate(3)
+	assert.NoError(t, err, "should not error")
+	assert.EqualValues(t, 1, start, "allocation should start from the beginning")
+	assert.EqualValues(t, 3, end, "allocation should start from the beginning")
+}
+
+func TestCheck(t *testing.T) {
+	_, a := makeAlloc()
+
+	_, _, err := a.Allocate(20)
+	assert.NoError(t, err, "should not error")
+	assert.NoError(t, a.Free(5, 10), "should not error")
+	assert.NoError(t, a.Check(), "allocator should be consistent")
+
+	a.setBit(7)
+	assert.EqualError(t, a.Check(), ErrInUseMissMatch.Error(), "should detect in use count")
+	a.setInUse(a.InUse() + 1)
+	assert.EqualError(t, a.Check(), ErrFreeListInvalid.Error(), "should detect used block on free list")
+	a.clearBit(7)
+	a.setInUse(a.InUse() - 1)
+
+	a.clearBit(0)
+	assert.EqualError(t, a.Check(), ErrHeaderNotUsed.Error(), "should detect free header")
+	a.setBit(0)
+
+	a.SetFlags(a.Flags() | lastFlag)
+	assert.EqualError(t, a.Check(), ErrFlagsReserved.Error(), "should detect reserved flag")
+}
+
+func TestCorruptedFreeList(t *testing.T) {
+	for _, r := range []freeRange{{10, 65535}, {15, 10}, {0, 5}} {
+		_, a := makeAlloc()
+
+		_, _, err := a.Allocate(20)
+		assert.NoError(t, err, "should not error")
+		assert.NoError(t, a.Free(5, 10), "should not error")
+		a.setFreeRangeAt(0, r)
+
+		start, end, err := a.Allocate(3)
+		assert.NoError(t, err, "should not error")
+		assert.EqualValues(t, 5, start, "freed blocks should be found by scanning")
+		assert.EqualValues(t, 7, end, "freed blocks should be found by scanning")
+		assert.Empty(t, a.FreeRanges(), "corrupted list should be cleared")
+		assert.True(t, a.Flags()&flagFreeListOverflow != 0, "overflow should be marked")
+		assert.NoError(t, a.Free(15, 16), "should not error")
+	}
+
+	_, a := makeAlloc()
+	a.setFreeCnt(1000)
+	_, _, err := a.Allocate(3)
+	assert.NoError(t, err, "should not error")
+	assert.Empty(t, a.FreeRanges(), "corrupted list should be cleared")
+}
@@ -9,15 +9,27 @@ const (
 	uuidEnd       = uuidStart + 16
 	flagsStart    = uuidEnd
 	flagsEnd      = flagsStart + 2
-	reservedStart = flagsEnd
-	reservedEnd   = reservedStart + 14
-	bitFieldStart = reservedEnd
+	inUseStart    = flagsEnd
+	inUseEnd      = inUseStart + 4
+	freeCntStart  = inUseEnd
+	freeCntEnd    = freeCntStart + 2
+	freeListStart = freeCntEnd
+	freeListEnd   = freeListStart + FreeListLength*freeRangeSize
+	bitFieldStart = freeListEnd
 	bitFieldEnd   = consts.BlockSize
 )
 
+const (
+	// FreeListLength is number of freed ranges remembered in the header, the
+	// list takes the bytes that were reserved so the header size and with
+	// it positions of allocators don't change
+	FreeListLength = 2
+	freeRangeSize  = 4
+)
+
 const (
 	headerStart = uuidStart
-	headerEnd   = reservedEnd
+	headerEnd   = bitFieldStart
 
 	AllocatorHeaderSize = headerEnd - headerStart
 	BlocksPerAllocator  = (consts.BlockSize - AllocatorHeaderSize) * 8
@@ -26,6 +38,7 @@ const (
 const (
 	flagFull = 1 << iota
 	flagFragmented
+	flagFreeListOverflow
 	// insert flags here
 
 	lastFlag
@@ -5,5 +5,15 @@ import (
 )
 
 var (
-	ErrOutOfSpace = errors.New("allocator is out of space")
+	ErrOutOfSpace   = errors.New("allocator is out of space")
+	ErrInvalidRange = errors.New("block range outside of allocator")
+	ErrNotAllocated = errors.New("freeing block that is not allocated")
+)
+
+// Errors returned by Check
+var (
+	ErrFlagsReserved   = errors.New("reserved flag is set")
+	ErrHeaderNotUsed   = errors.New("allocator block is marked as free")
+	ErrInUseMissMatch  = errors.New("blocks in use differ from the bitfield")
+	ErrFreeListInvalid = errors.New("free list holds invalid range")
 )
@@ -0,0 +1,175 @@
+package allocator
+
+// The free list is a short array of recently freed ranges kept in the
+// allocator header. Allocations consume it before scanning the bitfield.
+// Ranges that don't fit are dropped, the allocator is then marked with
+// flagFreeListOverflow and the tip is moved back so the scan finds them.
+
+type freeRange struct {
+	start, end uint
+}
+
+func (r freeRange) len() uint {
+	return r.end - r.start + 1
+}
+
+func (a *Allocator) freeCnt() uint {
+	return uint(binary.Uint16(a.blk[freeCntStart:freeCntEnd]))
+}
+
+func (a *Allocator) setFreeCnt(n uint) {
+	binary.PutUint16(a.blk[freeCntStart:freeCntEnd], uint16(n))
+}
+
+func (a *Allocator) freeRangeAt(i uint) freeRange {
+	off := freeListStart + i*freeRangeSize
+	return freeRange{
+		start: uint(binary.Uint16(a.blk[off : off+2])),
+		end:   uint(binary.Uint16(a.blk[off+2 : off+4])),
+	}
+}
+
+func (a *Allocator) setFreeRangeAt(i uint, r freeRange) {
+	off := freeListStart + i*freeRangeSize
+	binary.PutUint16(a.blk[off:off+2], uint16(r.start))
+	binary.PutUint16(a.blk[off+2:off+4], uint16(r.end))
+}
+
+// clearFreeList removes all entries
+func (a *Allocator) clearFreeList() {
+	for i := uint(0); i < FreeListLength; i++ {
+		a.setFreeRangeAt(i, freeRange{})
+	}
+	a.setFreeCnt(0)
+}
+
+// checkFreeList clears the free list if its header is corrupted, freed blocks
+// are then found by scanning the bitfield
+func (a *Allocator) checkFreeList() {
+	n := a.freeCnt()
+	ok := n <= FreeListLength
+	for i := uint(0); ok && i < n; i++ {
+		r := a.freeRangeAt(i)
+		ok = a.checkRange(r.start, r.end) == nil
+	}
+	if !ok {
+		a.clearFreeList()
+		a.overflow(0)
+	}
+}
+
+// removeFree removes i-th entry, the last entry takes its place
+func (a *Allocator) removeFree(i uint) {
+	last := a.freeCnt() - 1
+	a.setFreeRangeAt(i, a.freeRangeAt(last))
+	a.setFreeRangeAt(last, freeRange{})
+	a.setFreeCnt(last)
+}
+
+// FreeRanges returns the ranges currently on the free list
+func (a *Allocator) FreeRanges() [][2]uint {
+	a.checkFreeList()
+	out := make([][2]uint, 0, a.freeCnt())
+	for i := uint(0); i < a.freeCnt(); i++ {
+		r := a.freeRangeAt(i)
+		out = append(out, [2]uint{r.start, r.end})
+	}
+	return out
+}
+
+// overflow marks that freed blocks starting at start are not on the free list
+func (a *Allocator) overflow(start uint) {
+	a.SetFlags(a.Flags() | flagFreeListOverflow)
+	if start < a.tip {
+		a.tip = start
+	}
+}
+
+// pushFree adds range to the free list, merging it with adjacent entry.
+// Returns false if the list is full.
+func (a *Allocator) pushFree(start, end uint) bool {
+	a.checkFreeList()
+	n := a.freeCnt()
+	for i := uint(0); i < n; i++ {
+		r := a.freeRangeAt(i)
+		switch {
+		case r.end+1 == start:
+			r.end = end
+		case end+1 == r.start:
+			r.start = start
+		default:
+			continue
+		}
+		a.setFreeRangeAt(i, r)
+		return true
+	}
+
+	if n == FreeListLength {
+		return false
+	}
+	a.setFreeRangeAt(n, freeRange{start, end})
+	a.setFreeCnt(n + 1)
+	return true
+}
+
+// takeFree allocates from the free list. With exact set only a range of count
+// blocks is taken, otherwise first entry is used up to count blocks.
+func (a *Allocator) takeFree(count uint, exact bool) (uint, uint, bool) {
+	a.checkFreeList()
+	for i := uint(0); i < a.freeCnt(); i++ {
+		r := a.freeRangeAt(i)
+		if exact && r.len() < count {
+			continue
+		}
+
+		for b := r.start; b <= r.end; b++ {
+			if a.getBit(b) {
+				// list doesn't match the bitfield, fall back to scanning
+				a.setFreeCnt(0)
+				a.overflow(0)
+				return 0, 0, false
+			}
+		}
+
+		if count > r.len() {
+			count = r.len()
+		}
+		start, end := r.start, r.start+count-1
+		if end == r.end {
+			a.removeFree(i)
+		} else {
+			a.setFreeRangeAt(i, freeRange{end + 1, r.end})
+		}
+
+		for b := start; b <= end; b++ {
+			a.setBit(b)
+		}
+		return start, end, true
+	}
+	return 0, 0, false
+}
+
+// dropFree removes blocks in range [start, end] from the free list
+func (a *Allocator) dropFree(start, end uint) {
+	a.checkFreeList()
+	for i := uint(0); i < a.freeCnt(); {
+		r := a.freeRangeAt(i)
+		switch {
+		case r.end < start || r.start > end:
+			// no overlap
+		case r.start >= start && r.end <= end:
+			a.removeFree(i)
+			continue
+		case r.start < start && r.end > end:
+			a.setFreeRangeAt(i, freeRange{r.start, start - 1})
+			if !a.pushFree(end+1, r.end) {
+				a.overflow(end + 1)
+			}
+		case r.start < start:
+			a.setFreeRangeAt(i, freeRange{r.start, start - 1})
+		default:
+			a.setFreeRangeAt(i, freeRange{end + 1, r.end})
+		}
+		i++
+	}
+}
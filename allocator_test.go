@@ -11,7 +11,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ipfs/go-sbs/allocator"
 	"github.com/ipfs/go-sbs/consts"
+
+	"github.com/juju/errors"
 )
 
 var seed int64 = -1
@@ -80,7 +83,7 @@ func sbsDir(t *testing.T) string {
 func TestAllocatorOverrideTest(t *testing.T) {
 	rng := rng{}
 
-	t.Logf("%x", consts.BlocksPerAllocator*consts.BlockSize)
+	t.Logf("%x", allocator.BlocksPerAllocator*consts.BlockSize)
 
 	dir := sbsDir(t)
 	sbs, err := Open(dir)
@@ -157,28 +160,32 @@ func TestSampleExpand(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	blks, err := sbs.curAlloc.Allocate(math.MaxUint64)
-	if err != ErrAllocatorFull {
+	exts, err := sbs.allocateN(maxAllocation)
+	if err != nil {
 		t.Fatal(err)
 	}
-	if len(blks) < 8000 {
-		t.Fatalf("too little %d", len(blks))
+	if n := extentsLength(exts); n < 8000 {
+		t.Fatalf("too little %d", n)
+	}
+	_, _, err = sbs.curAlloc.Allocate(1)
+	if errors.Cause(err) != allocator.ErrOutOfSpace {
+		t.Fatal(err)
 	}
 	buf := make([]byte, consts.BlockSize)
 	for i, _ := range buf {
 		buf[i] = 0x41
 	}
 
-	for _, blk := range blks {
-		sbs.copyToStorage(buf, []uint64{blk})
+	for _, blk := range blocksOf(exts) {
+		sbs.copyToStorage(buf, []extent{{blk, 1}})
 	}
 
 	err = nil
-	err = sbs.expand()
+	err = sbs.expand(allocatorEnd(1))
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = sbs.expand()
+	err = sbs.expand(allocatorEnd(2))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -186,3 +193,33 @@ func TestSampleExpand(t *testing.T) {
 
 	os.RemoveAll(dir)
 }
+
+func TestAllocateFailure(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+	inUse := sbs.curAlloc.InUse()
+
+	// the volume can't grow through read only file
+	mmfi := sbs.mmfi
+	ro, err := os.Open(mmfi.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	sbs.mmfi = ro
+	_, err = sbs.allocateN(2 * maxAllocation)
+	sbs.mmfi = mmfi
+	if err == nil {
+		t.Fatal("allocation past the end of read only file should fail")
+	}
+
+	if sbs.curAlloc.InUse() != inUse {
+		t.Fatalf("%d blocks in use after failed allocation, expected %d", sbs.curAlloc.InUse(), inUse)
+	}
+}
@@ -0,0 +1,231 @@
+package sbs
+
+import (
+	"bytes"
+	"sort"
+
+	pb "github.com/ipfs/go-sbs/pb"
+)
+
+const (
+	// bulkChunk is how many blocks BulkLoader allocates at once (32MiB)
+	bulkChunk = 4096
+)
+
+// BulkOptions are used by BulkLoader
+type BulkOptions struct {
+	// records are inserted into the index once BufferRecords values are
+	// buffered
+	BufferRecords int
+	// TxRecords is the largest number of records inserted in one index
+	// transaction
+	TxRecords int
+
+	// Progress is called after each index transaction
+	Progress func(BulkProgress)
+}
+
+// DefaultBulkOptions are used when BulkLoader gets no options
+var DefaultBulkOptions = BulkOptions{
+	BufferRecords: 1 << 18,
+	TxRecords:     1 << 14,
+}
+
+// BulkProgress reports how far a bulk load got
+type BulkProgress struct {
+	// values written to blocks, their bytes and records inserted into
+	// the index
+	Values  uint64
+	Bytes   uint64
+	Indexed uint64
+}
+
+type bulkRecord struct {
+	k, data []byte
+}
+
+// BulkLoader stores large numbers of values faster than Put, meant for
+// initial import. Values are written one after another into ranges of blocks
+// allocated in large chunks, without flushing. Their records are buffered,
+// sorted and inserted into the index in key order in large transactions once
+// the buffer fills up, after the data file is flushed.
+//
+// Values are visible only after their records are inserted, Finish inserts
+// the rest and syncs the volume. A crash during the load leaks blocks of
+// values not yet indexed until recovery rebuilds the allocators. BulkLoader
+// can't be used concurrently, the volume can.
+type BulkLoader struct {
+	sbs  *Sbs
+	opts BulkOptions
+
+	recs []bulkRecord
+	// blocks allocated but not yet used by values
+	spare []extent
+
+	progress BulkProgress
+}
+
+// BulkLoader returns loader storing values in the volume, opts may be nil
+func (sbs *Sbs) BulkLoader(opts *BulkOptions) *BulkLoader {
+	if opts == nil {
+		opts = &DefaultBulkOptions
+	}
+	bl := &BulkLoader{
+		sbs:  sbs,
+		opts: *opts,
+	}
+	if bl.opts.BufferRecords <= 0 {
+		bl.opts.BufferRecords = DefaultBulkOptions.BufferRecords
+	}
+	if bl.opts.TxRecords <= 0 {
+		bl.opts.TxRecords = DefaultBulkOptions.TxRecords
+	}
+	return bl
+}
+
+// Put writes val and buffers its record under k
+func (bl *BulkLoader) Put(k, val []byte) error {
+	data, err := bl.store(val)
+	if err != nil {
+		return err
+	}
+
+	bl.recs = append(bl.recs, bulkRecord{append([]byte(nil), k...), data})
+	bl.progress.Values++
+	bl.progress.Bytes += uint64(len(val))
+	if len(bl.recs) >= bl.opts.BufferRecords {
+		return bl.Flush()
+	}
+	return nil
+}
+
+func (bl *BulkLoader) store(val []byte) ([]byte, error) {
+	sbs := bl.sbs
+	if len(val) < sbs.opts.InlineThreshold {
+		return createDirectRecord(val)
+	}
+
+	var data []byte
+	err := sbs.withLease(func() error {
+		exts, err := bl.take(blocksNeeded(uint64(len(val))))
+		if err != nil {
+			return err
+		}
+		sbs.copyToStorage(val, exts)
+
+		data, err = sbs.createBlocksRecord(uint64(len(val)), checksum(val), exts)
+		return err
+	})
+	return data, err
+}
+
+// take carves nblks blocks from the spare ones, allocating a new chunk when
+// they run out
+func (bl *BulkLoader) take(nblks uint64) ([]extent, error) {
+	var exts []extent
+	for nblks > 0 {
+		if len(bl.spare) == 0 {
+			n := uint64(bulkChunk)
+			if nblks > n {
+				n = nblks
+			}
+			spare, err := bl.sbs.allocateN(n)
+			if err != nil {
+				// blocks taken so far stay spare
+				bl.spare = exts
+				return nil, err
+			}
+			bl.spare = spare
+		}
+
+		e := bl.spare[0]
+		if e.length > nblks {
+			bl.spare[0] = extent{e.start + nblks, e.length - nblks}
+			e.length = nblks
+		} else {
+			bl.spare = bl.spare[1:]
+		}
+		nblks -= e.length
+
+		if l := len(exts) - 1; l >= 0 && exts[l].last()+1 == e.start {
+			exts[l].length += e.length
+		} else {
+			exts = append(exts, e)
+		}
+	}
+	return exts, nil
+}
+
+// Flush inserts buffered records into the index, values stored so far become
+// visible
+func (bl *BulkLoader) Flush() error {
+	if len(bl.recs) == 0 {
+		return nil
+	}
+	sbs := bl.sbs
+
+	// the index must not reference blocks that weren't written
+	if err := sbs.flushMapping(); err != nil {
+		return err
+	}
+
+	sort.SliceStable(bl.recs, func(i, j int) bool {
+		return bytes.Compare(bl.recs[i].k, bl.recs[j].k) < 0
+	})
+
+	for len(bl.recs) != 0 {
+		n := bl.opts.TxRecords
+		if n > len(bl.recs) {
+			n = len(bl.recs)
+		}
+
+		var unused []*pb.Record
+		err := sbs.index.Update(func(tx indexTx) error {
+			unused = nil
+			for _, r := range bl.recs[:n] {
+				prec, err := sbs.putRecord(tx, r.k, r.data)
+				if err != nil {
+					return err
+				}
+				if prec != nil {
+					unused = append(unused, prec)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		bl.recs = bl.recs[n:]
+		bl.progress.Indexed += uint64(n)
+
+		for _, prec := range unused {
+			if err := sbs.freeRecord(prec); err != nil {
+				return err
+			}
+		}
+		if bl.opts.Progress != nil {
+			bl.opts.Progress(bl.progress)
+		}
+	}
+	bl.recs = nil
+	return nil
+}
+
+// Finish inserts the remaining records, releases blocks allocated but not
+// used and syncs the volume. The loader can be used again after it.
+func (bl *BulkLoader) Finish() error {
+	if err := bl.Flush(); err != nil {
+		return err
+	}
+	if err := bl.sbs.free(bl.spare); err != nil {
+		return err
+	}
+	bl.spare = nil
+	return bl.sbs.Sync()
+}
+
+// Progress returns how far the load got
+func (bl *BulkLoader) Progress() BulkProgress {
+	return bl.progress
+}
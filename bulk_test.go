@@ -0,0 +1,103 @@
+package sbs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-sbs/consts"
+)
+
+func TestBulkLoader(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inUse := sbs.curAlloc.InUse()
+
+	var progress []BulkProgress
+	bl := sbs.BulkLoader(&BulkOptions{
+		BufferRecords: 7,
+		TxRecords:     3,
+		Progress: func(p BulkProgress) {
+			progress = append(progress, p)
+		},
+	})
+
+	const n = 20
+	size := func(i int) int {
+		return i*consts.BlockSize/2 + 1
+	}
+	var blocks uint64
+	for i := n - 1; i >= 0; i-- {
+		k := []byte(fmt.Sprintf("/key-%02d", i))
+		if err := bl.Put(k, testValue(int64(i), size(i))); err != nil {
+			t.Fatal(err)
+		}
+		if size(i) >= sbs.opts.InlineThreshold {
+			blocks += blocksNeeded(uint64(size(i)))
+		}
+	}
+
+	// the last records are still buffered
+	if has, err := sbs.Has([]byte("/key-00")); err != nil || has {
+		t.Fatalf("key-00 should not be indexed before Finish: %v", err)
+	}
+	if err := bl.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := bl.Progress()
+	if p.Values != n || p.Indexed != n {
+		t.Fatalf("wrong progress: %+v", p)
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != p {
+		t.Fatalf("progress was not reported: %v", progress)
+	}
+	// 20 records in buffers of 7 inserted 3 at a time
+	if len(progress) != 3+3+2 {
+		t.Fatalf("%d index transactions, expected 8", len(progress))
+	}
+
+	// values follow each other and unused blocks are released
+	prev, err := sbs.getPB([]byte("/key-19"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := n - 2; size(i) >= sbs.opts.InlineThreshold; i-- {
+		prec, err := sbs.getPB([]byte(fmt.Sprintf("/key-%02d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pexts, exts := recordExtents(prev), recordExtents(prec)
+		if pexts[len(pexts)-1].last()+1 != exts[0].start {
+			t.Fatalf("value of key-%02d is not stored right after the previous one", i)
+		}
+		prev = prec
+	}
+	if sbs.curAlloc.InUse() != inUse+uint(blocks) {
+		t.Fatalf("%d blocks in use, expected %d", sbs.curAlloc.InUse(), inUse+uint(blocks))
+	}
+
+	if err := sbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sbs, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+	for i := 0; i < n; i++ {
+		val, err := sbs.Get([]byte(fmt.Sprintf("/key-%02d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(val, testValue(int64(i), size(i))) {
+			t.Fatalf("value of key-%02d differs", i)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package sbs
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	pb "github.com/ipfs/go-sbs/pb"
+)
+
+// ErrCorrupted is the cause of CorruptedError and of errors of records
+// pointing outside of the volume
+var ErrCorrupted = fmt.Errorf("value is corrupted")
+
+// CorruptedError is returned when value read from the volume doesn't match
+// the checksum stored in its record
+type CorruptedError struct {
+	Key []byte
+	// Blocks lists ranges of blocks holding the value as [first, last]
+	Blocks [][2]uint64
+}
+
+func (e *CorruptedError) Error() string {
+	return fmt.Sprintf("%s: key %q, blocks %v", ErrCorrupted, e.Key, e.Blocks)
+}
+
+// Cause returns ErrCorrupted, so errors.Cause can be used to compare
+func (e *CorruptedError) Cause() error {
+	return ErrCorrupted
+}
+
+// values are protected with CRC32C, it is cheap enough to be verified on
+// every read
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(val []byte) uint32 {
+	return crc32.Checksum(val, castagnoli)
+}
+
+// verify checks val read from record of k against its checksum, records
+// written before checksums were introduced are not verified. A lease must be
+// held.
+func (sbs *Sbs) verify(k []byte, prec *pb.Record, val []byte) error {
+	if prec.Crc32C == nil || checksum(val) == prec.GetCrc32C() {
+		return nil
+	}
+
+	cerr := &CorruptedError{Key: append([]byte(nil), k...)}
+	if prec.GetType() != pb.Record_Direct {
+		err := sbs.walkExtents(prec, 0, func(e extent) error {
+			cerr.Blocks = append(cerr.Blocks, [2]uint64{e.start, e.last()})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return cerr
+}
+
+// extentError is returned for extent read from the volume that doesn't lie
+// within its data blocks
+type extentError struct {
+	e   extent
+	msg string
+}
+
+func (e *extentError) Error() string {
+	return fmt.Sprintf("extent %d+%d %s", e.e.start, e.e.length, e.msg)
+}
+
+// Cause returns ErrCorrupted, so errors.Cause can be used to compare
+func (e *extentError) Cause() error {
+	return ErrCorrupted
+}
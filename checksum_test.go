@@ -0,0 +1,225 @@
+package sbs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-sbs/consts"
+	pb "github.com/ipfs/go-sbs/pb"
+
+	proto "github.com/gogo/protobuf/proto"
+	query "github.com/ipfs/go-datastore/query"
+	"github.com/juju/errors"
+)
+
+func TestChecksums(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	direct := testValue(1, 10)
+	blocks := testValue(2, 2*consts.BlockSize+5)
+	streamed := testValue(3, 3*consts.BlockSize)
+	if err := sbs.Put([]byte("/direct"), direct); err != nil {
+		t.Fatal(err)
+	}
+	if err := sbs.Put([]byte("/blocks"), blocks); err != nil {
+		t.Fatal(err)
+	}
+	err = sbs.PutReaderUnknownSize([]byte("/streamed"), bytes.NewReader(streamed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string][]byte{"/direct": direct, "/blocks": blocks, "/streamed": streamed} {
+		prec, err := sbs.getPB([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prec.Crc32C == nil || prec.GetCrc32C() != checksum(v) {
+			t.Fatalf("record of %s has wrong checksum", k)
+		}
+	}
+
+	// flip a bit in the last block of the value
+	prec, err := sbs.getPB([]byte("/blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exts := recordExtents(prec)
+	sbs.mm[exts[0].last()*consts.BlockSize] ^= 1
+
+	checkCorrupted := func(err error) {
+		if errors.Cause(err) != ErrCorrupted {
+			t.Fatalf("expected ErrCorrupted, got: %v", err)
+		}
+		cerr := err.(*CorruptedError)
+		if string(cerr.Key) != "/blocks" {
+			t.Fatalf("wrong key of corrupted value: %s", cerr.Key)
+		}
+		if len(cerr.Blocks) != 1 || cerr.Blocks[0] != [2]uint64{exts[0].start, exts[0].last()} {
+			t.Fatalf("wrong blocks of corrupted value: %v", cerr.Blocks)
+		}
+	}
+
+	_, err = sbs.Get([]byte("/blocks"))
+	checkCorrupted(err)
+	err = sbs.View([]byte("/blocks"), func([]byte) error {
+		t.Fatal("corrupted value should not be viewed")
+		return nil
+	})
+	checkCorrupted(err)
+
+	fs := &Sbsds{sbs: sbs}
+	res, err := fs.Query(query.Query{Prefix: "/blocks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = res.Rest()
+	checkCorrupted(err)
+
+	if _, err := sbs.Get([]byte("/direct")); err != nil {
+		t.Fatal(err)
+	}
+
+	// records written before checksums are read without verification
+	prec.Crc32C = nil
+	data, err := proto.Marshal(prec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sbs.index.Update(func(tx indexTx) error {
+		return tx.Put([]byte("/blocks"), data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sbs.Get([]byte("/blocks")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordOutsideVolume(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	if err := sbs.Put([]byte("/blocks"), testValue(1, 3*consts.BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	prec, err := sbs.getPB([]byte("/blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end := allocatorStart(sbs.allocators())
+	for _, e := range []extent{{end - 1, 3}, {1 << 62, 3}, {end + 10, 1}, {0, 3}} {
+		prec.Extents = pbExtents([]extent{e})
+		data, err := proto.Marshal(prec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sbs.index.Update(func(tx indexTx) error {
+			return tx.Put([]byte("/blocks"), data)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := sbs.Get([]byte("/blocks")); errors.Cause(err) != ErrCorrupted {
+			t.Fatalf("extent %v: expected ErrCorrupted from Get, got: %v", e, err)
+		}
+		err = sbs.View([]byte("/blocks"), func([]byte) error {
+			t.Fatal("value outside of the volume should not be viewed")
+			return nil
+		})
+		if errors.Cause(err) != ErrCorrupted {
+			t.Fatalf("extent %v: expected ErrCorrupted from View, got: %v", e, err)
+		}
+	}
+
+	if err := sbs.Delete([]byte("/blocks")); errors.Cause(err) != ErrCorrupted {
+		t.Fatalf("expected ErrCorrupted from Delete, got: %v", err)
+	}
+}
+
+func TestCorruptedTrie(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	// leave one block holes so the value is listed in a trie
+	const holes = 16
+	for i := 0; i < 2*holes; i++ {
+		k := []byte(fmt.Sprintf("/filler-%02d", i))
+		if err := sbs.Put(k, testValue(int64(i), consts.BlockSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2*holes; i += 2 {
+		if err := sbs.Delete([]byte(fmt.Sprintf("/filler-%02d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sbs.Put([]byte("/trie"), testValue(1, holes*consts.BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	prec, err := sbs.getPB([]byte("/trie"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prec.GetType() != pb.Record_Trie {
+		t.Fatalf("value should be listed in a trie, got %s", prec.GetType())
+	}
+
+	// point the fourth entry of the trie far outside of the volume, the
+	// entries follow 16 bytes of header and take 16 bytes each
+	sbs.mm[prec.GetTrie()*consts.BlockSize+16+3*16+7] ^= 0x80
+
+	checkCorrupted := func(what string, err error) {
+		if errors.Cause(err) != ErrCorrupted {
+			t.Fatalf("expected ErrCorrupted from %s, got: %v", what, err)
+		}
+	}
+
+	_, err = sbs.Get([]byte("/trie"))
+	checkCorrupted("Get", err)
+
+	fs := &Sbsds{sbs: sbs}
+	res, err := fs.Query(query.Query{Prefix: "/trie"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = res.Rest()
+	checkCorrupted("Query", err)
+
+	var corrupt []string
+	_, err = sbs.Scrub(context.Background(), 0, func(k []byte, err error) {
+		checkCorrupted("Scrub", err)
+		corrupt = append(corrupt, string(k))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupt) != 1 || corrupt[0] != "/trie" {
+		t.Fatalf("expected /trie to be corrupted, got: %v", corrupt)
+	}
+}
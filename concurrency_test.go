@@ -0,0 +1,189 @@
+package sbs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-sbs/consts"
+
+	query "github.com/ipfs/go-datastore/query"
+)
+
+const (
+	concurrentKeys   = 64
+	concurrentRounds = 300
+)
+
+// concurrentValue is the only value ever stored under key i, so readers can
+// verify whatever they find
+func concurrentValue(i int) ([]byte, []byte) {
+	sizes := []int{10, 1000, consts.BlockSize, 3*consts.BlockSize + 1}
+	return []byte(fmt.Sprintf("/key-%d", i)), testValue(int64(i), sizes[i%len(sizes)])
+}
+
+func testConcurrentAccess(t *testing.T, opts *Options) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	run := func(fn func(rng *rand.Rand) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(rand.Int63()))
+			if err := fn(rng); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	check := func(i int, v []byte) error {
+		_, expected := concurrentValue(i)
+		if !bytes.Equal(v, expected) {
+			return fmt.Errorf("value of key %d differs", i)
+		}
+		return nil
+	}
+
+	for w := 0; w < 4; w++ {
+		run(func(rng *rand.Rand) error {
+			for r := 0; r < concurrentRounds; r++ {
+				i := rng.Intn(concurrentKeys)
+				k, v := concurrentValue(i)
+				var err error
+				switch rng.Intn(3) {
+				case 0:
+					err = sbs.Put(k, v)
+				case 1:
+					err = sbs.PutReader(k, bytes.NewReader(v), int64(len(v)))
+				default:
+					err = sbs.Delete(k)
+					if err == ErrNotFound {
+						err = nil
+					}
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	for w := 0; w < 4; w++ {
+		run(func(rng *rand.Rand) error {
+			for r := 0; r < concurrentRounds; r++ {
+				i := rng.Intn(concurrentKeys)
+				k, _ := concurrentValue(i)
+				switch rng.Intn(4) {
+				case 0:
+					v, err := sbs.Get(k)
+					if err == ErrNotFound {
+						continue
+					}
+					if err != nil {
+						return err
+					}
+					if err := check(i, v); err != nil {
+						return err
+					}
+				case 1:
+					err := sbs.View(k, func(v []byte) error {
+						return check(i, v)
+					})
+					if err != nil && err != ErrNotFound {
+						return err
+					}
+				case 2:
+					vr, err := sbs.Open(k)
+					if err == ErrNotFound {
+						continue
+					}
+					if err != nil {
+						return err
+					}
+					// value may be deleted while being read, what
+					// was read must be the value
+					v, err := ioutil.ReadAll(vr)
+					if err == ErrNotFound {
+						continue
+					}
+					if err != nil {
+						return err
+					}
+					if err := check(i, v); err != nil {
+						return err
+					}
+				default:
+					if _, err := sbs.Has(k); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	}
+
+	run(func(rng *rand.Rand) error {
+		fs := &Sbsds{sbs: sbs}
+		for r := 0; r < 10; r++ {
+			res, err := fs.Query(query.Query{})
+			if err != nil {
+				return err
+			}
+			entries, err := res.Rest()
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				var i int
+				if _, err := fmt.Sscanf(e.Key, "/key-%d", &i); err != nil {
+					return err
+				}
+				if err := check(i, e.Value.([]byte)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	// remap the data file while it is used
+	run(func(rng *rand.Rand) error {
+		for r := 0; r < 50; r++ {
+			sbs.allocLk.Lock()
+			err := sbs.expand(uint64(len(sbs.mm))/consts.BlockSize + 16)
+			sbs.allocLk.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	testConcurrentAccess(t, nil)
+}
+
+func TestConcurrentAccessHamt(t *testing.T) {
+	testConcurrentAccess(t, &Options{Index: IndexHamt, InlineThreshold: 256})
+}
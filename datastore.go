@@ -1,7 +1,8 @@
 package sbs
 
 import (
-	"github.com/boltdb/bolt"
+	pb "github.com/ipfs/go-sbs/pb"
+
 	ds "github.com/ipfs/go-datastore"
 )
 
@@ -11,7 +12,13 @@ type Sbsds struct {
 }
 
 func NewSbsDS(path string) (*Sbsds, error) {
-	sbs, err := Open(path)
+	return NewSbsDSWithOptions(path, nil)
+}
+
+// NewSbsDSWithOptions opens datastore backed by sbs volume in path, see
+// OpenWithOptions
+func NewSbsDSWithOptions(path string, opts *Options) (*Sbsds, error) {
+	sbs, err := OpenWithOptions(path, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -27,16 +34,33 @@ func (fs *Sbsds) Put(key ds.Key, value interface{}) error {
 	if !ok {
 		return ds.ErrInvalidType
 	}
+	if err := fs.verify(VerifyPut, key, b); err != nil {
+		return err
+	}
 
 	return fs.sbs.Put(key.Bytes(), b)
 }
 
+// verify checks val against multihash in key if mode is enabled
+func (fs *Sbsds) verify(mode VerifyMode, key ds.Key, val []byte) error {
+	if fs.sbs.opts.Verify&mode == 0 {
+		return nil
+	}
+	return verifyContent(key, val)
+}
+
 func (fs *Sbsds) Get(key ds.Key) (value interface{}, err error) {
 	val, err := fs.sbs.Get(key.Bytes())
 	if err == ErrNotFound {
 		return nil, ds.ErrNotFound
 	}
-	return val, err
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.verify(VerifyGet, key, val); err != nil {
+		return nil, err
+	}
+	return val, nil
 }
 
 func (fs *Sbsds) Has(key ds.Key) (exists bool, err error) {
@@ -72,56 +96,90 @@ func (bt *sbsbatch) Put(key ds.Key, val interface{}) error {
 	if !ok {
 		return ds.ErrInvalidType
 	}
+	if err := bt.fs.verify(VerifyPut, key, b); err != nil {
+		return err
+	}
 
+	// the last operation on a key wins
+	delete(bt.deletes, key)
 	bt.puts[key] = b
 	return nil
 }
 
 func (bt *sbsbatch) Delete(key ds.Key) error {
+	delete(bt.puts, key)
 	bt.deletes[key] = struct{}{}
 	return nil
 }
 
+// Commit applies puts and deletes of the batch in a single index transaction.
+// Blocks of the new values are freed if it fails, deleting an absent key is
+// not an error.
 func (bt *sbsbatch) Commit() error {
+	sbs := bt.fs.sbs
 	indexData := make(map[ds.Key][]byte)
 
 	for k, val := range bt.puts {
-		nblks := blocksNeeded(uint64(len(val)))
-		blks, err := bt.fs.sbs.allocateN(nblks)
-		if err != nil {
+		if skip, err := sbs.skipPut(k.Bytes()); err != nil {
+			bt.discard(indexData)
 			return err
+		} else if skip {
+			continue
 		}
 
-		bt.fs.sbs.copyToStorage(val, blks)
-
-		data, err := createRecord(val, blks)
+		data, err := sbs.store(val)
 		if err != nil {
+			bt.discard(indexData)
 			return err
 		}
 
 		indexData[k] = data
 	}
 
-	bt.fs.sbs.index.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketOffset)
+	var unused []*pb.Record
+	err := sbs.commit(true, func(tx indexTx) error {
+		unused = nil
 		for k, v := range indexData {
-			err := b.Put(k.Bytes(), v)
+			prec, err := sbs.putRecord(tx, k.Bytes(), v)
+			if err != nil {
+				return err
+			}
+			if prec != nil {
+				unused = append(unused, prec)
+			}
+		}
+		for k := range bt.deletes {
+			prec, err := sbs.deleteRecord(tx, k.Bytes())
 			if err != nil {
 				return err
 			}
+			if prec != nil {
+				unused = append(unused, prec)
+			}
 		}
 		return nil
 	})
+	if err != nil {
+		bt.discard(indexData)
+		return err
+	}
 
-	for k, _ := range bt.deletes {
-		if err := bt.fs.Delete(k); err != nil {
+	for _, prec := range unused {
+		if err := sbs.freeRecord(prec); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
+// discard frees blocks of values stored by Commit that didn't make it to
+// the index
+func (bt *sbsbatch) discard(indexData map[ds.Key][]byte) {
+	for _, data := range indexData {
+		bt.fs.sbs.discardRecord(data)
+	}
+}
+
 func (fs *Sbsds) Close() error {
 	return fs.sbs.Close()
 }
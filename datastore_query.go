@@ -7,63 +7,46 @@ import (
 	ds "github.com/ipfs/go-datastore"
 	query "github.com/ipfs/go-datastore/query"
 	"github.com/jbenet/goprocess"
+)
 
-	"github.com/boltdb/bolt"
+const (
+	// queryChunk is the largest number of records Query reads under one
+	// lease
+	queryChunk = 64
 )
 
 func (fs *Sbsds) Query(q query.Query) (query.Results, error) {
 	qrb := query.NewResultBuilder(q)
 
 	qrb.Process.Go(func(worker goprocess.Process) {
-		fs.sbs.index.View(func(tx *bolt.Tx) error {
-
-			buck := tx.Bucket(bucketOffset)
-			c := buck.Cursor()
-
-			var prefix []byte
-			if qrb.Query.Prefix != "" {
-				prefix = []byte(qrb.Query.Prefix)
-			}
-
-			cur := 0
-			sent := 0
-			for k, v := c.Seek(prefix); k != nil; k, v = c.Next() {
-				if cur < qrb.Query.Offset {
-					cur++
-					continue
-				}
-				if qrb.Query.Limit > 0 && sent >= qrb.Query.Limit {
-					break
-				}
-				dk := ds.RawKey(string(k)).String()
-				e := query.Entry{Key: dk}
-
-				if !qrb.Query.KeysOnly {
-					var prec pb.Record
-
-					err := proto.Unmarshal(v, &prec)
-					if err != nil {
-						qrb.Output <- query.Result{Error: err}
-						return err
-					}
-					l := prec.GetSize_()
-					buf := make([]byte, l)
-					fs.sbs.read(&prec, buf)
-
-					e.Value = buf
-				}
+		// the index is read in chunks, neither the index nor a lease is
+		// held while results are consumed
+		qc := queryCursor{
+			q:    qrb.Query,
+			skip: qrb.Query.Offset,
+			left: qrb.Query.Limit,
+		}
+		if qc.q.Prefix != "" {
+			qc.prefix = []byte(qc.q.Prefix)
+		}
 
+		for {
+			entries, done, err := fs.queryChunk(&qc)
+			for _, e := range entries {
 				select {
 				case qrb.Output <- query.Result{Entry: e}: // we sent it out
-					sent++
 				case <-worker.Closing(): // client told us to end early.
-					break
+					return
 				}
-				cur++
 			}
-
-			return nil
-		})
+			if err != nil {
+				qrb.Output <- query.Result{Error: err}
+				return
+			}
+			if done {
+				return
+			}
+		}
 	})
 
 	// go wait on the worker (without signaling close)
@@ -78,3 +61,84 @@ func (fs *Sbsds) Query(q query.Query) (query.Results, error) {
 	}
 	return qr, nil
 }
+
+// queryCursor is position of a query in the index
+type queryCursor struct {
+	q      query.Query
+	prefix []byte
+	// after is the last record visited, skip is number of records still to
+	// be skipped and left number of entries still to be returned if limit
+	// is set
+	after []byte
+	skip  int
+	left  int
+}
+
+// queryChunk reads entries of at most queryChunk records following the
+// cursor and moves it past them, done is set once there are no more.
+// Records are collected first so the index isn't held while values are read,
+// the lease keeps their blocks from being reused until then.
+func (fs *Sbsds) queryChunk(qc *queryCursor) (entries []query.Entry, done bool, err error) {
+	err = fs.sbs.withLease(func() error {
+		var keys, recs [][]byte
+		err := fs.sbs.index.View(func(tx indexTx) error {
+			err := tx.ForEach(qc.prefix, qc.after, func(k, v []byte) error {
+				if len(keys) == queryChunk || (qc.q.Limit > 0 && qc.left == len(keys)) {
+					return errStopIteration
+				}
+				if qc.skip > 0 {
+					qc.skip--
+					qc.after = append([]byte{}, k...)
+					return nil
+				}
+				keys = append(keys, append([]byte{}, k...))
+				if !qc.q.KeysOnly {
+					recs = append(recs, append([]byte{}, v...))
+				}
+				return nil
+			})
+			if err == errStopIteration {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		done = len(keys) < queryChunk
+		if len(keys) != 0 {
+			qc.after = keys[len(keys)-1]
+		}
+		if qc.q.Limit > 0 {
+			qc.left -= len(keys)
+			done = done || qc.left == 0
+		}
+
+		for i, k := range keys {
+			dk := ds.RawKey(string(k))
+			e := query.Entry{Key: dk.String()}
+
+			if !qc.q.KeysOnly {
+				var prec pb.Record
+
+				err := proto.Unmarshal(recs[i], &prec)
+				if err != nil {
+					return err
+				}
+				l := prec.GetSize_()
+				buf := make([]byte, l)
+				if err := fs.sbs.read(k, &prec, buf); err != nil {
+					return err
+				}
+				if err := fs.verify(VerifyGet, dk, buf); err != nil {
+					return err
+				}
+
+				e.Value = buf
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, done, err
+}
@@ -1,9 +1,16 @@
 package sbs
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/ipfs/go-sbs/consts"
+
+	ds "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
 	dtest "github.com/ipfs/go-datastore/test"
 )
 
@@ -31,6 +38,92 @@ func TestDatastoreBatchDelete(t *testing.T) {
 	os.RemoveAll(dir)
 }
 
+// failingIndex fails all index updates
+type failingIndex struct {
+	index
+}
+
+func (failingIndex) Update(func(tx indexTx) error) error {
+	return fmt.Errorf("update failed")
+}
+
+func TestDatastoreBatchAtomic(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	fs, err := NewSbsDS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	sbs := fs.sbs
+
+	a, b, c := ds.NewKey("/a"), ds.NewKey("/b"), ds.NewKey("/c")
+	for i, k := range []ds.Key{a, b} {
+		if err := fs.Put(k, testValue(int64(i), 2*consts.BlockSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inUse := sbs.curAlloc.InUse()
+
+	// failed commit changes nothing and frees blocks it stored
+	batch, err := fs.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Put(c, testValue(3, 3*consts.BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Delete(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Delete(ds.NewKey("/absent")); err != nil {
+		t.Fatal(err)
+	}
+	// the last operation on a key wins
+	if err := batch.Delete(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Put(b, testValue(4, consts.BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := sbs.index
+	sbs.index = failingIndex{idx}
+	if err := batch.Commit(); err == nil {
+		t.Fatal("expected commit to fail")
+	}
+	sbs.index = idx
+	if sbs.curAlloc.InUse() != inUse {
+		t.Fatalf("blocks of failed commit were not freed, %d in use, expected %d",
+			sbs.curAlloc.InUse(), inUse)
+	}
+	if has, err := fs.Has(a); err != nil || !has {
+		t.Fatalf("a should be kept after failed commit: %v", err)
+	}
+	if has, err := fs.Has(c); err != nil || has {
+		t.Fatalf("c should not be stored after failed commit: %v", err)
+	}
+
+	// deleting absent key doesn't fail the batch
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Get(a); err != ds.ErrNotFound {
+		t.Fatalf("expected a to be deleted, got: %v", err)
+	}
+	if v, err := fs.Get(b); err != nil || len(v.([]byte)) != consts.BlockSize {
+		t.Fatalf("b should be replaced: %v", err)
+	}
+	if _, err := fs.Get(c); err != nil {
+		t.Fatal(err)
+	}
+	// blocks of a and old b are freed, c and new b take as many
+	if sbs.curAlloc.InUse() != inUse {
+		t.Fatalf("%d blocks in use, expected %d", sbs.curAlloc.InUse(), inUse)
+	}
+}
+
 func TestDatastoreQuery(t *testing.T) {
 	t.Skip("reenable after go-datastore update")
 	dir := sbsDir(t)
@@ -72,3 +165,76 @@ func TestDatastoreNotFound(t *testing.T) {
 
 	os.RemoveAll(dir)
 }
+
+func TestDatastoreQueryChunks(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+	fs := &Sbsds{sbs: sbs}
+
+	const n = 3*queryChunk + 5
+	size := func(i int) int {
+		return 100 + i%3*consts.BlockSize
+	}
+	for i := 0; i < n; i++ {
+		k := []byte(fmt.Sprintf("/key-%03d", i))
+		if err := sbs.Put(k, testValue(int64(i), size(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(q query.Query, first, count int) {
+		res, err := fs.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != count {
+			t.Fatalf("%+v: %d entries, expected %d", q, len(entries), count)
+		}
+		for j, e := range entries {
+			i := first + j
+			if e.Key != fmt.Sprintf("/key-%03d", i) {
+				t.Fatalf("%+v: entry %d is %s", q, j, e.Key)
+			}
+			if !q.KeysOnly && !bytes.Equal(e.Value.([]byte), testValue(int64(i), size(i))) {
+				t.Fatalf("%+v: value of %s differs", q, e.Key)
+			}
+		}
+	}
+	check(query.Query{}, 0, n)
+	check(query.Query{KeysOnly: true}, 0, n)
+	check(query.Query{Offset: queryChunk + 3, Limit: queryChunk + 10}, queryChunk+3, queryChunk+10)
+	check(query.Query{Offset: 10, Limit: queryChunk}, 10, queryChunk)
+	check(query.Query{Offset: n - 2, Limit: 10}, n-2, 2)
+	check(query.Query{Prefix: "/key-1"}, 100, n-100)
+
+	// no lease is held while results wait to be consumed
+	res, err := fs.Query(query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	if r, ok := res.NextSync(); !ok || r.Error != nil {
+		t.Fatalf("no first result: %v", r.Error)
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		sbs.leaseLk.Lock()
+		active := len(sbs.leases.active)
+		sbs.leaseLk.Unlock()
+		if active == 0 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("lease is held while results are consumed")
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package sbs
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/ipfs/go-sbs/allocator"
+	"github.com/ipfs/go-sbs/consts"
+	pb "github.com/ipfs/go-sbs/pb"
+
+	proto "github.com/gogo/protobuf/proto"
+)
+
+var (
+	keyDefragCursor = []byte("defrag-cursor")
+)
+
+const (
+	// allocators with less than sparseBlocks in use are emptied by Defragment
+	sparseBlocks = allocator.BlocksPerAllocator / 4
+
+	// cursorCheckpoint is how often background passes over the index
+	// remember their position
+	cursorCheckpoint = 5 * time.Second
+)
+
+// Defragment relocates values that are split into multiple runs of blocks or
+// that live in sparsely used allocators into contiguous runs.
+//
+// Each value is moved by copying its blocks and swapping the index record in
+// a single transaction, the old blocks are freed afterwards. Processing stops
+// once budget blocks were moved or ctx is done, the position is remembered
+// in the index every few seconds and on return so the next call continues
+// where this one stopped. A resumed pass wraps around at the end of the index
+// and ends where it started. Returns the number of blocks moved, 0 means there
+// was nothing left to do.
+func (sbs *Sbs) Defragment(ctx context.Context, budget uint64) (uint64, error) {
+	var moved uint64
+	inUse := make(map[uint64]uint)
+
+	cursor, err := sbs.cursor(keyDefragCursor)
+	if err != nil {
+		return 0, err
+	}
+	start, wrapped := cursor, false
+	// records skipped since the cursor was last stored
+	skipped := false
+	saved := time.Now()
+	save := func(err error) error {
+		if !skipped {
+			return err
+		}
+		if serr := sbs.setCursor(keyDefragCursor, cursor); err == nil {
+			err = serr
+		}
+		return err
+	}
+
+	for moved < budget {
+		if err := ctx.Err(); err != nil {
+			return moved, save(err)
+		}
+
+		k, v, err := sbs.nextRecord(cursor)
+		if err != nil {
+			return moved, save(err)
+		}
+		if k == nil && start != nil && !wrapped {
+			// records before the resume point are visited too
+			cursor, wrapped = nil, true
+			continue
+		}
+		if k == nil || (wrapped && bytes.Equal(k, start)) {
+			// pass over the index is done, start from the beginning next time
+			return moved, sbs.setCursor(keyDefragCursor, nil)
+		}
+
+		var prec pb.Record
+		if err := proto.Unmarshal(v, &prec); err != nil {
+			return moved, save(err)
+		}
+
+		if !sbs.needsDefrag(&prec, inUse) {
+			cursor, skipped = k, true
+			if time.Since(saved) >= cursorCheckpoint {
+				if err := save(nil); err != nil {
+					return moved, err
+				}
+				skipped, saved = false, time.Now()
+			}
+			continue
+		}
+
+		// the cursor is stored together with the new record
+		n, err := sbs.relocate(k, v, &prec)
+		if err != nil {
+			return moved, save(err)
+		}
+		cursor, skipped, saved = k, false, time.Now()
+		moved += n
+		// allocators changed, their usage has to be read again
+		inUse = make(map[uint64]uint)
+	}
+
+	return moved, save(nil)
+}
+
+// cursor returns the last key processed by a background pass over the index
+// remembered in meta record name, nil if there is none
+func (sbs *Sbs) cursor(name []byte) ([]byte, error) {
+	var cursor []byte
+	err := sbs.index.View(func(tx indexTx) error {
+		if c := tx.GetMeta(name); c != nil {
+			cursor = append([]byte{}, c...)
+		}
+		return nil
+	})
+	return cursor, err
+}
+
+func (sbs *Sbs) setCursor(name, k []byte) error {
+	return sbs.index.Update(func(tx indexTx) error {
+		return putCursor(tx, name, k)
+	})
+}
+
+func putCursor(tx indexTx, name, k []byte) error {
+	if k == nil {
+		return tx.DeleteMeta(name)
+	}
+	return tx.PutMeta(name, k)
+}
+
+// nextRecord returns the first record after key after in the index order
+func (sbs *Sbs) nextRecord(after []byte) ([]byte, []byte, error) {
+	var k, v []byte
+	err := sbs.index.View(func(tx indexTx) error {
+		err := tx.ForEach(nil, after, func(ck, cv []byte) error {
+			k = append([]byte{}, ck...)
+			v = append([]byte{}, cv...)
+			return errStopIteration
+		})
+		if err == errStopIteration {
+			return nil
+		}
+		return err
+	})
+	return k, v, err
+}
+
+// needsDefrag reports whether value should be moved, inUse caches block usage
+// of allocators
+func (sbs *Sbs) needsDefrag(prec *pb.Record, inUse map[uint64]uint) bool {
+	if prec.GetType() == pb.Record_Trie {
+		// values listed in a trie are left where they are
+		return false
+	}
+
+	exts := recordExtents(prec)
+	if len(exts) == 0 {
+		return false
+	}
+	for _, e := range exts {
+		// broken records are left to fsck
+		if sbs.checkExtent(e) != nil {
+			return false
+		}
+	}
+
+	if extentsLength(exts) <= maxAllocation && len(exts) > 1 {
+		return true
+	}
+
+	sbs.allocLk.Lock()
+	defer sbs.allocLk.Unlock()
+
+	for _, e := range exts {
+		n, _ := allocatorOf(e.start)
+		if n == sbs.curAlloc.n {
+			continue
+		}
+		used, ok := inUse[n]
+		if !ok {
+			alloc, err := sbs.loadAllocator(n)
+			if err != nil {
+				return false
+			}
+			used = alloc.InUse()
+			inUse[n] = used
+		}
+		if used < sparseBlocks {
+			return true
+		}
+	}
+	return false
+}
+
+// relocate moves value of record v stored under k to newly allocated blocks
+// and returns number of blocks moved. If the record changed in the meantime
+// nothing is moved.
+func (sbs *Sbs) relocate(k, v []byte, prec *pb.Record) (uint64, error) {
+	oldExts := recordExtents(prec)
+	nblks := extentsLength(oldExts)
+
+	var exts []extent
+	if nblks <= maxAllocation {
+		e, err := sbs.allocateContiguous(nblks)
+		if err != nil {
+			return 0, err
+		}
+		exts = []extent{e}
+	} else {
+		var err error
+		exts, err = sbs.allocateN(nblks)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err := sbs.withLease(func() error {
+		mm := sbs.mapping()
+		oldBlks := blocksOf(oldExts)
+		for i, blk := range blocksOf(exts) {
+			dst := blk * consts.BlockSize
+			src := oldBlks[i] * consts.BlockSize
+			copy(mm[dst:dst+consts.BlockSize], mm[src:src+consts.BlockSize])
+		}
+		return nil
+	})
+	if err == nil {
+		err = sbs.syncExtents(exts)
+	}
+	if err != nil {
+		sbs.free(exts)
+		return 0, err
+	}
+
+	nrec := *prec
+	nrec.Blocks = nil
+	nrec.Extents = pbExtents(exts)
+	data, err := proto.Marshal(&nrec)
+	if err != nil {
+		sbs.free(exts)
+		return 0, err
+	}
+
+	swapped := false
+	err = sbs.commit(false, func(tx indexTx) error {
+		if bytes.Equal(tx.Get(k), v) {
+			if err := tx.Put(k, data); err != nil {
+				return err
+			}
+			swapped = true
+		}
+		return putCursor(tx, keyDefragCursor, k)
+	})
+	if err != nil || !swapped {
+		if ferr := sbs.free(exts); ferr != nil && err == nil {
+			err = ferr
+		}
+		return 0, err
+	}
+
+	return nblks, sbs.freeLeased(oldExts)
+}
@@ -0,0 +1,239 @@
+package sbs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-sbs/consts"
+)
+
+func testValue(seed int64, size int) []byte {
+	v := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(v)
+	return v
+}
+
+func fragmentedValues(t *testing.T, sbs *Sbs, n int) map[string][]byte {
+	vals := make(map[string][]byte)
+
+	var holes [][]byte
+	for i := 0; i < 2*n; i++ {
+		k := []byte(fmt.Sprintf("filler-%d", i))
+		v := testValue(int64(i), 3*consts.BlockSize)
+		if err := sbs.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			holes = append(holes, k)
+			continue
+		}
+		vals[string(k)] = v
+	}
+	for _, k := range holes {
+		if err := sbs.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each of these fills two holes
+	for i := 0; i < n/2; i++ {
+		k := []byte(fmt.Sprintf("frag-%d", i))
+		v := testValue(int64(-i), 6*consts.BlockSize)
+		if err := sbs.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+		prec, err := sbs.getPB(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recordExtents(prec)) < 2 {
+			t.Fatal("value should have been fragmented")
+		}
+		vals[string(k)] = v
+	}
+	return vals
+}
+
+func checkValues(t *testing.T, sbs *Sbs, vals map[string][]byte) {
+	for k, v := range vals {
+		val, err := sbs.Get([]byte(k))
+		if err != nil {
+			t.Fatalf("%s: %s", k, err)
+		}
+		if !bytes.Equal(val, v) {
+			t.Fatalf("%s: retrieved data not correct", k)
+		}
+	}
+}
+
+func TestDefragment(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	vals := fragmentedValues(t, sbs, 8)
+	inUse := sbs.curAlloc.InUse()
+
+	moved, err := sbs.Defragment(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 4*6 {
+		t.Fatalf("expected %d blocks moved, got %d", 4*6, moved)
+	}
+	if sbs.curAlloc.InUse() != inUse {
+		t.Fatalf("old blocks not freed: %d in use, expected %d",
+			sbs.curAlloc.InUse(), inUse)
+	}
+
+	for k := range vals {
+		prec, err := sbs.getPB([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recordExtents(prec)) != 1 {
+			t.Fatalf("%s: value still fragmented", k)
+		}
+	}
+	checkValues(t, sbs, vals)
+
+	moved, err = sbs.Defragment(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 0 {
+		t.Fatalf("nothing should be left to move, moved %d", moved)
+	}
+}
+
+func TestDefragmentResume(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := fragmentedValues(t, sbs, 8)
+
+	moved, err := sbs.Defragment(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 6 {
+		t.Fatalf("expected single value moved, moved %d blocks", moved)
+	}
+
+	if err := sbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sbs, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+	checkValues(t, sbs, vals)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	moved, err = sbs.Defragment(ctx, 1000)
+	if err != context.Canceled || moved != 0 {
+		t.Fatalf("canceled defragment should not move, got %d, %v", moved, err)
+	}
+
+	total := uint64(6)
+	for {
+		moved, err := sbs.Defragment(context.Background(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if moved == 0 {
+			break
+		}
+		total += moved
+	}
+	if total != 4*6 {
+		t.Fatalf("expected %d blocks moved in total, got %d", 4*6, total)
+	}
+	checkValues(t, sbs, vals)
+}
+
+func TestDefragmentWrapAround(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	vals := fragmentedValues(t, sbs, 8)
+	// the last key of the index, fragmented values are all before it
+	if err := sbs.Put([]byte("zzz"), testValue(0, consts.BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sbs.setCursor(keyDefragCursor, []byte("zzz")); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := sbs.Defragment(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 4*6 {
+		t.Fatalf("expected %d blocks moved, got %d", 4*6, moved)
+	}
+	checkValues(t, sbs, vals)
+
+	moved, err = sbs.Defragment(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 0 {
+		t.Fatalf("nothing should be left to move, moved %d", moved)
+	}
+}
+
+func TestDefragmentSkipsWithoutCommits(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	for i := 0; i < 20; i++ {
+		k := []byte(fmt.Sprintf("/key-%d", i))
+		if err := sbs.Put(k, testValue(int64(i), 2*consts.BlockSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nothing needs moving, only the finished pass is recorded
+	ci := &countingIndex{index: sbs.index}
+	sbs.index = ci
+	defer func() { sbs.index = ci.index }()
+	moved, err := sbs.Defragment(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 0 {
+		t.Fatalf("nothing should be moved, moved %d", moved)
+	}
+	if ci.updates != 1 {
+		t.Fatalf("%d index updates for a pass over healthy volume", ci.updates)
+	}
+}
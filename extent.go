@@ -0,0 +1,125 @@
+package sbs
+
+import (
+	pb "github.com/ipfs/go-sbs/pb"
+	"github.com/ipfs/go-sbs/trie"
+
+	proto "github.com/gogo/protobuf/proto"
+)
+
+// extent is a run of length consecutive blocks starting at block start. As
+// allocator blocks are never handed out an extent never spans two allocators.
+type extent struct {
+	start  uint64
+	length uint64
+}
+
+// last returns the last block of the extent
+func (e extent) last() uint64 {
+	return e.start + e.length - 1
+}
+
+// extentsOf splits list of blocks into extents of consecutive blocks
+func extentsOf(blks []uint64) []extent {
+	var exts []extent
+	for _, blk := range blks {
+		if l := len(exts) - 1; l >= 0 && exts[l].last()+1 == blk {
+			exts[l].length++
+			continue
+		}
+		exts = append(exts, extent{blk, 1})
+	}
+	return exts
+}
+
+// blocksOf returns blocks of the extents in order
+func blocksOf(exts []extent) []uint64 {
+	blks := make([]uint64, 0, extentsLength(exts))
+	for _, e := range exts {
+		for blk := e.start; blk <= e.last(); blk++ {
+			blks = append(blks, blk)
+		}
+	}
+	return blks
+}
+
+// extentsLength returns total number of blocks in the extents
+func extentsLength(exts []extent) uint64 {
+	var n uint64
+	for _, e := range exts {
+		n += e.length
+	}
+	return n
+}
+
+// recordExtents returns extents holding value of the record, records written
+// before extents were introduced list every block
+func recordExtents(prec *pb.Record) []extent {
+	if len(prec.GetExtents()) == 0 {
+		return extentsOf(prec.GetBlocks())
+	}
+
+	exts := make([]extent, 0, len(prec.GetExtents()))
+	for _, e := range prec.GetExtents() {
+		exts = append(exts, extent{e.GetStart(), e.GetLength()})
+	}
+	return exts
+}
+
+func pbExtents(exts []extent) []*pb.Extent {
+	pexts := make([]*pb.Extent, 0, len(exts))
+	for _, e := range exts {
+		pexts = append(pexts, &pb.Extent{
+			Start:  proto.Uint64(e.start),
+			Length: proto.Uint64(e.length),
+		})
+	}
+	return pexts
+}
+
+func trieExtents(exts []extent) []trie.Extent {
+	texts := make([]trie.Extent, 0, len(exts))
+	for _, e := range exts {
+		texts = append(texts, trie.Extent{Start: e.start, Length: e.length})
+	}
+	return texts
+}
+
+// walkExtents calls fn for extents of the value of indirect or trie record in
+// order, skipping first blocks of the value. Extents are checked before they
+// are passed to fn, error with ErrCorrupted cause is returned for ones outside
+// of the volume. Iteration stops at first error returned by fn,
+// errStopIteration is not passed on.
+func (sbs *Sbs) walkExtents(prec *pb.Record, first uint64, fn func(e extent) error) error {
+	check := func(e extent) error {
+		if err := sbs.checkExtent(e); err != nil {
+			return err
+		}
+		return fn(e)
+	}
+
+	var err error
+	if prec.GetType() == pb.Record_Trie {
+		err = trie.ForEach(volumeStorage{sbs}, prec.GetTrie(), first, func(e trie.Extent) error {
+			return check(extent{e.Start, e.Length})
+		})
+	} else {
+		for _, e := range recordExtents(prec) {
+			if first >= e.length {
+				first -= e.length
+				continue
+			}
+			e.start += first
+			e.length -= first
+			first = 0
+			if err = check(e); err != nil {
+				break
+			}
+		}
+	}
+
+	if err == errStopIteration {
+		return nil
+	}
+	return err
+}
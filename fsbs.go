@@ -4,138 +4,559 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/ipfs/go-sbs/allocator"
 	"github.com/ipfs/go-sbs/consts"
 	pb "github.com/ipfs/go-sbs/pb"
+	"github.com/ipfs/go-sbs/superblock"
+	"github.com/ipfs/go-sbs/trie"
 
-	"github.com/boltdb/bolt"
 	proto "github.com/gogo/protobuf/proto"
 	mmap "github.com/gxed/mmap-go"
+	"github.com/juju/errors"
+	uuid "github.com/satori/go.uuid"
 )
 
 var ErrNotFound = fmt.Errorf("not found")
 
-var (
-	bucketOffset = []byte("offsets")
+// ErrForeignAllocator is returned when allocator block belongs to different
+// volume than the superblock
+var ErrForeignAllocator = fmt.Errorf("allocator UUID doesn't match the volume")
+
+// ErrNotVolume is returned when data file holds neither a superblock nor
+// allocator of the legacy layout with an index to upgrade
+var ErrNotVolume = fmt.Errorf("data file doesn't hold sbs volume")
+
+// ErrClosed is returned when records are committed after the volume was
+// closed
+var ErrClosed = fmt.Errorf("volume is closed")
+
+// ErrVolumeTooSmall is returned when data file is too small to hold
+// the superblock and the first allocator
+var ErrVolumeTooSmall = fmt.Errorf("data file too small to be sbs volume")
+
+const (
+	superblockIndex = 0
+
+	// maxAllocation is the largest range requested from an allocator at once,
+	// the first block of each allocator is its header
+	maxAllocation = allocator.BlocksPerAllocator - 1
+
+	// values split into more extents are listed in a block trie
+	maxRecordExtents = 8
 )
 
+// volAllocator is an allocator together with its position in the volume
+type volAllocator struct {
+	*allocator.Allocator
+	n uint64
+}
+
+// Sbs is a volume of the static blob store.
+//
+// All methods except Close can be called concurrently. Reads run in parallel
+// with each other and with writes, allocation and freeing of blocks is
+// serialized. Code touching the mapped data file holds a lease (see View), so
+// when the volume grows the old mapping is unmapped only after all its users
+// are done, and freed blocks are not reused while a reader may still follow
+// a record it read before the value was deleted.
 type Sbs struct {
 	Mem []byte
 
 	mmfi  *os.File
 	mm    mmap.MMap
-	index *bolt.DB
+	index index
+	sb    *superblock.Superblock
+
+	// allocLk serializes allocation, freeing and growth of the volume,
+	// curAlloc and allocator blocks are guarded by it
+	allocLk  sync.Mutex
+	curAlloc *volAllocator
+	// allocators modified since they were last flushed
+	dirtyAllocs map[uint64]struct{}
+
+	// leases of mapped memory, sbs.mm is guarded by both leaseLk and allocLk
+	leaseLk sync.Mutex
+	leases  leases
+
+	opts Options
+	// set if the volume was not closed cleanly, recovery holds changes
+	// made by recovery pass, nil if there was none
+	unclean  bool
+	recovery *RecoveryStats
+
+	// commits records of Puts with GroupCommit, nil otherwise
+	group *groupCommitter
+
+	// set if the volume is opened for offline checks only, nothing is
+	// written to it
+	readOnly bool
+}
 
-	alloc    *AllocatorBlock
-	curAlloc *AllocatorBlock
+// Options are used when opening sbs volume
+type Options struct {
+	// Index selects the index backend of new volumes, existing volumes keep
+	// the one they were created with
+	Index IndexType
+
+	// values shorter than InlineThreshold bytes are kept directly in the
+	// index record instead of data blocks, 0 disables inlining
+	InlineThreshold int
+
+	// Sync selects when written data is made durable
+	Sync SyncMode
+
+	// Verify selects when values stored through Sbsds are checked against
+	// the multihash encoded in their keys
+	Verify VerifyMode
+
+	// with SkipExisting Put of a key that is already stored keeps the stored
+	// value, meant for content addressed keys where the values are the same.
+	// Otherwise the value is replaced and its blocks are freed.
+	SkipExisting bool
+
+	// with GroupCommit records of concurrent Puts are committed together in
+	// one index transaction. It waits at most CommitDelay for more Puts
+	// after the first one and holds at most CommitSize records, 0 means no
+	// limit. Each Put still returns once its record is committed.
+	GroupCommit bool
+	CommitDelay time.Duration
+	CommitSize  int
 }
 
+// SyncMode selects when data is flushed to the disk
+type SyncMode int
+
+const (
+	// SyncAlways flushes value blocks and allocators before each record is
+	// committed to the index, the index commits durably
+	SyncAlways SyncMode = iota
+	// SyncBatch flushes data and the index only on batch commits and Sync,
+	// after a crash other writes may be lost or point at unwritten blocks
+	SyncBatch
+	// SyncNone leaves flushing to Sync and Close, meant for bulk loads. Any
+	// write since the last Sync may be lost or broken by a crash.
+	SyncNone
+)
+
+// DefaultOptions are used by Open
+var DefaultOptions = Options{
+	Index:           IndexBolt,
+	InlineThreshold: 256,
+	Sync:            SyncAlways,
+}
+
+// Open opens sbs volume located in path with DefaultOptions, creating it if it
+// doesn't exist yet.
 func Open(path string) (*Sbs, error) {
+	return OpenWithOptions(path, nil)
+}
+
+// OpenWithOptions opens sbs volume located in path, creating it if it doesn't
+// exist yet. Block 0 of the data file holds the superblock, allocators are
+// placed after it. If the data file exists but doesn't hold a valid
+// superblock the error from superblock.OpenSuperblock is returned (use
+// errors.Cause to compare). Data files written with the legacy layout
+// (allocator in block 0) are upgraded in place.
+func OpenWithOptions(path string, opts *Options) (*Sbs, error) {
+	if opts == nil {
+		opts = &DefaultOptions
+	}
 	datapath := filepath.Join(path, "data")
 	indexpath := filepath.Join(path, "index")
 
-	db, err := bolt.Open(indexpath, 0600, nil)
+	sbs, fresh, err := openData(datapath, false)
 	if err != nil {
 		return nil, err
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(bucketOffset)
-		return err
-	})
-	if err != nil {
+
+	if err := sbs.init(indexpath, fresh, opts, true); err != nil {
+		sbs.close(false)
 		return nil, err
 	}
+	if opts.GroupCommit {
+		sbs.group = newGroupCommitter(sbs, opts.CommitDelay, opts.CommitSize)
+	}
+	return sbs, nil
+}
+
+// openData maps the data file, creating it unless readOnly is set. Mapping of
+// read only data file can't be written to.
+func openData(datapath string, readOnly bool) (*Sbs, bool, error) {
+	flag, prot := os.O_RDWR, mmap.RDWR
+	if readOnly {
+		flag, prot = os.O_RDONLY, mmap.RDONLY
+	}
 
-	fi, err := os.OpenFile(datapath, os.O_RDWR, 0300)
+	fresh := false
+	fi, err := os.OpenFile(datapath, flag, 0300)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return nil, err
+		if !os.IsNotExist(err) || readOnly {
+			return nil, false, err
 		}
 
 		fi, err = os.Create(datapath)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		err = fi.Truncate(int64(consts.BlockSize * consts.BlocksPerAllocator))
+		err = fi.Truncate(int64(allocatorEnd(0) * consts.BlockSize))
 		if err != nil {
-			return nil, err
+			fi.Close()
+			return nil, false, err
 		}
+		fresh = true
 	}
 
-	mm, err := mmap.Map(fi, mmap.RDWR, 0)
+	st, err := fi.Stat()
 	if err != nil {
-		return nil, err
+		fi.Close()
+		return nil, false, err
+	}
+	if st.Size() < consts.BlockSize {
+		fi.Close()
+		return nil, false, ErrVolumeTooSmall
 	}
 
-	alloc, err := LoadAllocator(mm[:consts.BlockSize])
+	mm, err := mmap.Map(fi, prot, 0)
 	if err != nil {
-		return nil, err
+		fi.Close()
+		return nil, false, err
 	}
 
 	return &Sbs{
 		mmfi:     fi,
 		mm:       mm,
-		index:    db,
-		alloc:    alloc,
-		curAlloc: alloc,
+		readOnly: readOnly,
+	}, fresh, nil
+}
+
+// init loads the volume and its index, volumes that were not closed cleanly
+// are recovered if autoRecover is set
+func (sbs *Sbs) init(indexpath string, fresh bool, opts *Options, autoRecover bool) error {
+	sbs.opts = *opts
+
+	if !fresh && isLegacyVolume(sbs.superblockBlk(), uint64(len(sbs.mm))/consts.BlockSize) {
+		// legacy volumes always used bolt, without it there is nothing to
+		// upgrade
+		if _, err := os.Stat(indexpath); err != nil {
+			if os.IsNotExist(err) {
+				return ErrNotVolume
+			}
+			return err
+		}
+		bi, err := openBoltIndex(indexpath, opts.Sync != SyncAlways)
+		if err != nil {
+			return err
+		}
+		sbs.index = bi
+
+		if err := sbs.upgradeLegacy(); err != nil {
+			return err
+		}
+	}
+
+	if uint64(len(sbs.mm)) < allocatorEnd(0)*consts.BlockSize {
+		return ErrVolumeTooSmall
+	}
+
+	if fresh {
+		if err := superblock.Format(sbs.superblockBlk()); err != nil {
+			return err
+		}
+		if opts.Index == IndexHamt {
+			superblock.NewWriter(sbs.superblockBlk()).SetFlags(superblock.FlagHamtIndex)
+		}
+	}
+
+	if err := sbs.loadSuperblock(); err != nil {
+		return err
+	}
+
+	alloc, err := sbs.pickAllocator()
+	if err != nil {
+		return err
+	}
+	sbs.curAlloc = alloc
+
+	if sbs.index == nil {
+		switch {
+		case sbs.sb.Flags()&superblock.FlagHamtIndex == 0:
+			sbs.index, err = openBoltIndex(indexpath, opts.Sync != SyncAlways)
+		case fresh:
+			var hi *hamtIndex
+			hi, err = createHamtIndex(sbs)
+			if err == nil {
+				superblock.NewWriter(sbs.superblockBlk()).SetIndexRoot(hi.h.Root())
+				sbs.index = hi
+			}
+		default:
+			sbs.index, err = openHamtIndex(sbs, sbs.sb.IndexRoot())
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	clean := fresh || sbs.sb.Flags()&superblock.FlagClean != 0
+	if err := sbs.markOpen(); err != nil {
+		return err
+	}
+	if clean {
+		return nil
+	}
+	sbs.unclean = true
+	if !autoRecover {
+		return nil
+	}
+
+	// blocks allocated or freed around a crash may not match the index
+	sbs.recovery, err = sbs.recoverAllocators()
+	if err != nil {
+		return err
+	}
+	return sbs.Sync()
+}
+
+// initReadOnly loads the volume and its index without writing anything,
+// allocators are not loaded. Legacy volumes are not upgraded.
+func (sbs *Sbs) initReadOnly(indexpath string, opts *Options) error {
+	sbs.opts = *opts
+
+	if uint64(len(sbs.mm)) < allocatorEnd(0)*consts.BlockSize {
+		return ErrVolumeTooSmall
+	}
+	if err := sbs.loadSuperblock(); err != nil {
+		return err
+	}
+
+	var err error
+	if sbs.sb.Flags()&superblock.FlagHamtIndex == 0 {
+		sbs.index, err = openBoltIndexReadOnly(indexpath)
+	} else {
+		sbs.index, err = openHamtIndex(sbs, sbs.sb.IndexRoot())
+	}
+	if err != nil {
+		return err
+	}
+	sbs.unclean = sbs.sb.Flags()&superblock.FlagClean == 0
+	return nil
+}
+
+func (sbs *Sbs) superblockBlk() []byte {
+	return sbs.mm[superblockIndex*consts.BlockSize : (superblockIndex+1)*consts.BlockSize]
+}
+
+func (sbs *Sbs) loadSuperblock() error {
+	sb, err := superblock.OpenSuperblock(sbs.superblockBlk())
+	if err != nil {
+		return err
+	}
+	sbs.sb = sb
+	return nil
+}
+
+// allocatorStart returns index of the block holding the n-th allocator
+func allocatorStart(n uint64) uint64 {
+	return superblockIndex + 1 + n*allocator.BlocksPerAllocator
+}
+
+// allocatorEnd returns index of first block after range of the n-th allocator
+func allocatorEnd(n uint64) uint64 {
+	return allocatorStart(n + 1)
+}
+
+// allocatorOf returns the number of allocator responsible for given block
+// and index of that block within the allocator
+func allocatorOf(blk uint64) (uint64, uint) {
+	rel := blk - allocatorStart(0)
+	return rel / allocator.BlocksPerAllocator, uint(rel % allocator.BlocksPerAllocator)
+}
+
+func (sbs *Sbs) allocatorBlk(n uint64) []byte {
+	beg := allocatorStart(n) * consts.BlockSize
+	return sbs.mm[beg : beg+consts.BlockSize]
+}
+
+// loadAllocator opens the n-th allocator, formatting it if it was never used
+func (sbs *Sbs) loadAllocator(n uint64) (*volAllocator, error) {
+	blk := sbs.allocatorBlk(n)
+	alloc := allocator.OpenAllocator(blk)
+
+	u := alloc.UUID()
+	switch {
+	case uuid.Equal(u, uuid.Nil):
+		if err := allocator.FormatAllocator(blk, sbs.sb.UUID()); err != nil {
+			return nil, err
+		}
+		sbs.markDirty(n)
+		if n >= sbs.sb.AllocatorCount() {
+			superblock.NewWriter(sbs.superblockBlk()).SetAllocatorCount(n + 1)
+		}
+	case !uuid.Equal(u, sbs.sb.UUID()):
+		return nil, ErrForeignAllocator
+	}
+
+	return &volAllocator{
+		Allocator: alloc,
+		n:         n,
 	}, nil
 }
 
+// allocatorFor returns the n-th allocator, sharing state with curAlloc
+// if it is the current one
+func (sbs *Sbs) allocatorFor(n uint64) (*volAllocator, error) {
+	if sbs.curAlloc != nil && sbs.curAlloc.n == n {
+		return sbs.curAlloc, nil
+	}
+	return sbs.loadAllocator(n)
+}
+
+// Close syncs and closes the volume and marks it as cleanly shut down
 func (sbs *Sbs) Close() error {
-	if err := sbs.index.Close(); err != nil {
-		return err
+	return sbs.close(true)
+}
+
+// close closes the volume, it is marked as cleanly shut down only if clean is
+// set, volumes that failed to open or are read only are not
+func (sbs *Sbs) close(clean bool) error {
+	if sbs.group != nil {
+		// Puts racing with close see the committer stopped
+		sbs.group.stop()
+	}
+	if sbs.index != nil {
+		// freed blocks are not flushed until the next commit even in
+		// SyncAlways mode
+		if !sbs.readOnly {
+			if err := sbs.Sync(); err != nil {
+				return err
+			}
+		}
+		if err := sbs.index.Close(); err != nil {
+			return err
+		}
+		if clean && !sbs.readOnly {
+			if err := sbs.markClean(); err != nil {
+				return err
+			}
+		}
 	}
 
+	for _, r := range sbs.leases.retired {
+		if err := r.mm.Unmap(); err != nil {
+			return err
+		}
+	}
 	if err := sbs.mm.Unmap(); err != nil {
 		return err
 	}
 
-	return nil
+	return sbs.mmfi.Close()
 }
 
 func (sbs *Sbs) nextAllocator() error {
-	currEnd := sbs.curAlloc.Offset + consts.BlocksPerAllocator
-	newEnd := currEnd + consts.BlocksPerAllocator
-	if uint64(len(sbs.mm)) < newEnd*consts.BlockSize {
-		err := sbs.expand()
+	n := sbs.curAlloc.n + 1
+	if uint64(len(sbs.mm)) < allocatorEnd(n)*consts.BlockSize {
+		err := sbs.expand(allocatorEnd(n))
 		if err != nil {
 			return err
 		}
 	}
 
-	nalloc, err := LoadAllocator(sbs.mm[currEnd*consts.BlockSize : newEnd*consts.BlockSize])
+	nalloc, err := sbs.loadAllocator(n)
 	if err != nil {
 		return err
 	}
-	nalloc.Offset = currEnd
 	sbs.curAlloc = nalloc
-
-	_ = sbs.mm[newEnd*consts.BlockSize-1] // range check
+	superblock.NewWriter(sbs.superblockBlk()).SetCurrentAllocator(n)
 
 	return nil
 
 }
 
-func (sbs *Sbs) expand() error {
-	currEnd := sbs.curAlloc.Offset + consts.BlocksPerAllocator
-	newEnd := int64(currEnd + consts.BlocksPerAllocator)
+// pickAllocator returns allocator to continue allocating from when the volume
+// is opened: the one recorded in the superblock, or the first one after it
+// (wrapping around) that isn't full. Only headers are read. The recorded
+// allocator is a hint, it is flushed together with the rest of the volume.
+func (sbs *Sbs) pickAllocator() (*volAllocator, error) {
+	count := sbs.sb.AllocatorCount()
+	if count == 0 || count > sbs.allocators() {
+		// not recorded by older versions
+		count = sbs.allocators()
+	}
+	cur := sbs.sb.CurrentAllocator()
+	if cur >= count {
+		cur = 0
+	}
 
-	err := sbs.mmfi.Truncate(newEnd * consts.BlockSize)
-	if err != nil {
-		return err
+	var alloc *volAllocator
+	for i := uint64(0); i < count; i++ {
+		var err error
+		alloc, err = sbs.loadAllocator((cur + i) % count)
+		if err != nil {
+			return nil, err
+		}
+		if !alloc.IsFull() {
+			break
+		}
+	}
+	if alloc.IsFull() && alloc.n != count-1 {
+		// all are full, new allocators are added after the last one
+		var err error
+		if alloc, err = sbs.loadAllocator(count - 1); err != nil {
+			return nil, err
+		}
+	}
+
+	w := superblock.NewWriter(sbs.superblockBlk())
+	w.SetCurrentAllocator(alloc.n)
+	if sbs.sb.AllocatorCount() < count {
+		w.SetAllocatorCount(count)
 	}
+	return alloc, nil
+}
 
-	err = sbs.mm.Unmap()
+// expand grows the data file to nblks blocks and remaps it. Allocators loaded
+// before the remap, except the current one, are no longer valid and have to
+// be loaded again. The old
+// mapping stays in place until all leases are released.
+func (sbs *Sbs) expand(nblks uint64) error {
+	err := sbs.mmfi.Truncate(int64(nblks * consts.BlockSize))
 	if err != nil {
 		return err
 	}
+	if sbs.opts.Sync != SyncNone {
+		// new size has to be durable before anything is stored past the
+		// old end
+		if err := sbs.mmfi.Sync(); err != nil {
+			return err
+		}
+	}
 
 	nmm, err := mmap.Map(sbs.mmfi, mmap.RDWR, 0)
 	if err != nil {
 		return err
 	}
 
-	sbs.mm = nmm
+	if err := sbs.replaceMap(nmm); err != nil {
+		return err
+	}
+
+	if sbs.sb != nil {
+		sb, err := superblock.OpenSuperblock(sbs.superblockBlk())
+		if err != nil {
+			return err
+		}
+		sbs.sb = sb
+	}
+	if sbs.curAlloc != nil {
+		alloc, err := sbs.loadAllocator(sbs.curAlloc.n)
+		if err != nil {
+			return err
+		}
+		sbs.curAlloc = alloc
+	}
 
 	return nil
 }
@@ -148,79 +569,247 @@ func blocksNeeded(length uint64) uint64 {
 	return nblks
 }
 
-func (sbs *Sbs) allocateN(nblks uint64) ([]uint64, error) {
-	blks := make([]uint64, 0, nblks)
+func (sbs *Sbs) allocateN(nblks uint64) ([]extent, error) {
+	sbs.allocLk.Lock()
+	defer sbs.allocLk.Unlock()
+
+	var exts []extent
+	var got uint64
+
+	for got != nblks {
+		count := nblks - got
+		if count > maxAllocation {
+			count = maxAllocation
+		}
 
-	for uint64(len(blks)) != nblks {
-		mblks, err := sbs.curAlloc.Allocate(nblks - uint64(len(blks)))
-		switch err {
-		case ErrAllocatorFull:
+		start, end, err := sbs.curAlloc.AllocateUpTo(uint(count))
+		switch errors.Cause(err) {
+		case allocator.ErrOutOfSpace:
 			err = sbs.nextAllocator()
-			if err != nil {
-				return nil, err
-			}
-			fallthrough
 		case nil:
-			blks = append(blks, mblks...)
-		default:
+			sbs.markDirty(sbs.curAlloc.n)
+			base := allocatorStart(sbs.curAlloc.n)
+			e := extent{base + uint64(start), uint64(end-start) + 1}
+			if l := len(exts) - 1; l >= 0 && exts[l].last()+1 == e.start {
+				exts[l].length += e.length
+			} else {
+				exts = append(exts, e)
+			}
+			got += e.length
+		}
+		if err != nil {
+			// blocks allocated so far were not handed out yet
+			if ferr := sbs.freeExtents(exts); ferr != nil {
+				return nil, ferr
+			}
 			return nil, err
 		}
 	}
 
-	return blks, nil
+	return exts, nil
 }
 
-func (sbs *Sbs) copyToStorage(val []byte, blks []uint64) {
-	for i, blk := range blks {
-		l := consts.BlockSize
-		beg := i * consts.BlockSize
+// allocateContiguous allocates nblks consecutive blocks, nblks can't be
+// larger than maxAllocation
+func (sbs *Sbs) allocateContiguous(nblks uint64) (extent, error) {
+	sbs.allocLk.Lock()
+	defer sbs.allocLk.Unlock()
 
-		if bufleft := len(val) - beg; bufleft < l {
+	for {
+		start, end, err := sbs.curAlloc.Allocate(uint(nblks))
+		switch errors.Cause(err) {
+		case allocator.ErrOutOfSpace:
+			err = sbs.nextAllocator()
+			if err != nil {
+				return extent{}, err
+			}
+		case nil:
+			sbs.markDirty(sbs.curAlloc.n)
+			base := allocatorStart(sbs.curAlloc.n)
+			return extent{base + uint64(start), uint64(end-start) + 1}, nil
+		default:
+			return extent{}, err
+		}
+	}
+}
+
+// copyToStorage writes val to blocks of exts, a lease must be held
+func (sbs *Sbs) copyToStorage(val []byte, exts []extent) {
+	mm := sbs.mapping()
+	var beg uint64
+	for _, e := range exts {
+		l := e.length * consts.BlockSize
+		if bufleft := uint64(len(val)) - beg; bufleft < l {
 			l = bufleft
 		}
-		//fmt.Printf("trying to write: %d, blocklen: %d", blk, len(sbs.mm)/consts.BlockSize)
-		blkoff := blk * consts.BlockSize
-		copy(sbs.mm[blkoff:blkoff+uint64(l)], val[beg:beg+l])
+		off := e.start * consts.BlockSize
+		copy(mm[off:off+l], val[beg:beg+l])
+		beg += l
 	}
 }
 
-func createRecord(val []byte, blks []uint64) ([]byte, error) {
-	t := pb.Record_Indirect
+func createDirectRecord(val []byte) ([]byte, error) {
+	t := pb.Record_Direct
 	rec := &pb.Record{
-		Blocks: blks,
 		Size_:  proto.Uint64(uint64(len(val))),
+		Data:   val,
+		Type:   &t,
+		Crc32C: proto.Uint32(checksum(val)),
+	}
+
+	return proto.Marshal(rec)
+}
+
+func createRecord(size uint64, crc uint32, exts []extent) ([]byte, error) {
+	t := pb.Record_Indirect
+	rec := &pb.Record{
+		Extents: pbExtents(exts),
+		Size_:   proto.Uint64(size),
+		Type:    &t,
+		Crc32C:  proto.Uint32(crc),
+	}
+
+	return proto.Marshal(rec)
+}
+
+// store writes val to the volume and returns serialized record of it
+func (sbs *Sbs) store(val []byte) ([]byte, error) {
+	if len(val) < sbs.opts.InlineThreshold {
+		return createDirectRecord(val)
+	}
+
+	var data []byte
+	err := sbs.withLease(func() error {
+		exts, err := sbs.allocateN(blocksNeeded(uint64(len(val))))
+		if err != nil {
+			return err
+		}
+		sbs.copyToStorage(val, exts)
+		if err := sbs.syncExtents(exts); err != nil {
+			sbs.free(exts)
+			return err
+		}
+
+		data, err = sbs.createBlocksRecord(uint64(len(val)), checksum(val), exts)
+		return err
+	})
+	return data, err
+}
+
+// createBlocksRecord returns record of value of size bytes with checksum crc
+// stored in exts, exts are freed if the record can't be created
+func (sbs *Sbs) createBlocksRecord(size uint64, crc uint32, exts []extent) ([]byte, error) {
+	if len(exts) <= maxRecordExtents {
+		return createRecord(size, crc, exts)
+	}
+
+	root, err := trie.Build(volumeStorage{sbs}, trieExtents(exts))
+	if err == nil {
+		err = sbs.syncTrie(root)
+		if err != nil {
+			trie.Free(volumeStorage{sbs}, root)
+		}
+	}
+	if err != nil {
+		if ferr := sbs.free(exts); ferr != nil {
+			return nil, ferr
+		}
+		return nil, err
+	}
+	return createTrieRecord(size, crc, root)
+}
+
+func createTrieRecord(size uint64, crc uint32, root uint64) ([]byte, error) {
+	t := pb.Record_Trie
+	rec := &pb.Record{
+		Trie:   proto.Uint64(root),
+		Size_:  proto.Uint64(size),
 		Type:   &t,
+		Crc32C: proto.Uint32(crc),
 	}
 
 	return proto.Marshal(rec)
 }
 
 func (sbs *Sbs) Put(k []byte, val []byte) error {
-	nblks := blocksNeeded(uint64(len(val)))
-	blks, err := sbs.allocateN(nblks)
+	if skip, err := sbs.skipPut(k); skip || err != nil {
+		return err
+	}
+
+	data, err := sbs.store(val)
 	if err != nil {
 		return err
 	}
-	data, err := createRecord(val, blks)
+	return sbs.commitPut(k, data)
+}
+
+// commitPut commits record data of k and frees blocks of the record it
+// replaces, with GroupCommit together with records of concurrent Puts. Blocks
+// of data are freed if it can't be committed.
+func (sbs *Sbs) commitPut(k, data []byte) error {
+	var unused *pb.Record
+	var err error
+	if sbs.group != nil {
+		unused, err = sbs.group.commit(k, data)
+	} else {
+		err = sbs.commit(false, func(tx indexTx) error {
+			var err error
+			unused, err = sbs.putRecord(tx, k, data)
+			return err
+		})
+	}
 	if err != nil {
+		sbs.discardRecord(data)
 		return err
 	}
+	return sbs.freeRecord(unused)
+}
+
+// discardRecord frees blocks of record data that didn't make it to the index
+func (sbs *Sbs) discardRecord(data []byte) {
+	var prec pb.Record
+	if err := proto.Unmarshal(data, &prec); err != nil {
+		return
+	}
+	sbs.freeRecord(&prec)
+}
 
-	sbs.copyToStorage(val, blks)
+// skipPut reports whether Put of k can be skipped without storing the value
+func (sbs *Sbs) skipPut(k []byte) (bool, error) {
+	if !sbs.opts.SkipExisting {
+		return false, nil
+	}
+	return sbs.Has(k)
+}
 
-	err = sbs.index.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketOffset)
-		return b.Put(k, data)
-	})
+// putRecord stores record data under k in tx. Returns record that is no
+// longer referenced once tx commits and whose blocks should be freed then:
+// the replaced one, or the new one if the key exists and SkipExisting is set.
+func (sbs *Sbs) putRecord(tx indexTx, k, data []byte) (*pb.Record, error) {
+	old := tx.Get(k)
+	if len(old) != 0 && sbs.opts.SkipExisting {
+		old = data
+	} else if err := tx.Put(k, data); err != nil {
+		return nil, err
+	}
+	if len(old) == 0 {
+		return nil, nil
+	}
 
-	return err
+	var prec pb.Record
+	if err := proto.Unmarshal(old, &prec); err != nil {
+		// blocks of broken record are leaked rather than failing the put,
+		// fsck finds them
+		return nil, nil
+	}
+	return &prec, nil
 }
 
 func (sbs *Sbs) getPB(k []byte) (*pb.Record, error) {
 	var prec pb.Record
 
-	err := sbs.index.View(func(tx *bolt.Tx) error {
-		rec := tx.Bucket(bucketOffset).Get(k)
+	err := sbs.index.View(func(tx indexTx) error {
+		rec := tx.Get(k)
 		if len(rec) == 0 {
 			return ErrNotFound
 		}
@@ -233,8 +822,8 @@ func (sbs *Sbs) getPB(k []byte) (*pb.Record, error) {
 
 func (sbs *Sbs) Has(k []byte) (bool, error) {
 	has := false
-	err := sbs.index.View(func(tx *bolt.Tx) error {
-		rec := tx.Bucket(bucketOffset).Get(k)
+	err := sbs.index.View(func(tx indexTx) error {
+		rec := tx.Get(k)
 		if len(rec) != 0 {
 			has = true
 		}
@@ -243,67 +832,176 @@ func (sbs *Sbs) Has(k []byte) (bool, error) {
 	return has, err
 }
 
-func (sbs *Sbs) read(prec *pb.Record, out []byte) {
+// read copies value of record of k to out and verifies its checksum, a lease
+// must be held
+func (sbs *Sbs) read(k []byte, prec *pb.Record, out []byte) error {
+	if prec.GetType() == pb.Record_Direct {
+		copy(out, prec.GetData())
+		return sbs.verify(k, prec, out)
+	}
+
+	mm := sbs.mapping()
 	var beg uint64
-	for _, blk := range prec.GetBlocks() {
-		l := uint64(consts.BlockSize)
+	err := sbs.walkExtents(prec, 0, func(e extent) error {
+		l := e.length * consts.BlockSize
 		if lsize := uint64(len(out)) - beg; lsize < l {
 			l = lsize
 		}
-		blkoff := blk * consts.BlockSize
-		copy(out[beg:beg+l], sbs.mm[blkoff:blkoff+l])
+		off := e.start * consts.BlockSize
+		copy(out[beg:beg+l], mm[off:off+l])
 		beg += l
+		if beg == uint64(len(out)) {
+			return errStopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	return sbs.verify(k, prec, out)
 }
 
 func (sbs *Sbs) Get(k []byte) ([]byte, error) {
-	prec, err := sbs.getPB(k)
+	var out []byte
+	err := sbs.withLease(func() error {
+		prec, err := sbs.getPB(k)
+		if err != nil {
+			return err
+		}
+
+		out = make([]byte, prec.GetSize_())
+		return sbs.read(k, prec, out)
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	out := make([]byte, prec.GetSize_())
-	sbs.read(prec, out)
 	return out, nil
 }
 
 func (sbs *Sbs) Delete(k []byte) error {
-	var prec pb.Record
+	var prec *pb.Record
 
-	err := sbs.index.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketOffset)
-		rec := b.Get(k)
-		if len(rec) == 0 {
+	err := sbs.index.Update(func(tx indexTx) error {
+		var err error
+		prec, err = sbs.deleteRecord(tx, k)
+		if err == nil && prec == nil {
 			return ErrNotFound
 		}
-		err := b.Delete(k)
-		if err != nil {
-			return err
-		}
-
-		return proto.Unmarshal(rec, &prec)
+		return err
 	})
 	if err != nil {
 		return err
 	}
 
-	tofree := make(map[uint64][]uint64)
-	for _, blk := range prec.GetBlocks() {
-		wa := blk / consts.BlocksPerAllocator
-		wi := blk % consts.BlocksPerAllocator
-		tofree[wa] = append(tofree[wa], wi)
+	return sbs.freeRecord(prec)
+}
+
+// deleteRecord removes record of k in tx and returns it so its blocks can be
+// freed once tx commits, nil if k doesn't exist
+func (sbs *Sbs) deleteRecord(tx indexTx, k []byte) (*pb.Record, error) {
+	rec := tx.Get(k)
+	if len(rec) == 0 {
+		return nil, nil
+	}
+	var prec pb.Record
+	if err := proto.Unmarshal(rec, &prec); err != nil {
+		return nil, err
 	}
 
-	for wa, list := range tofree {
-		beg := wa * consts.BlockSize * consts.BlocksPerAllocator
-		alloc, err := LoadAllocator(sbs.mm[beg : beg+consts.BlockSize])
+	return &prec, tx.Delete(k)
+}
+
+// free releases blocks of the extents
+func (sbs *Sbs) free(exts []extent) error {
+	sbs.allocLk.Lock()
+	defer sbs.allocLk.Unlock()
+
+	return sbs.freeExtents(exts)
+}
+
+// freeExtents releases blocks of exts right away, allocLk must be held
+func (sbs *Sbs) freeExtents(exts []extent) error {
+	for _, e := range exts {
+		wa, start := allocatorOf(e.start)
+		_, end := allocatorOf(e.last())
+
+		alloc, err := sbs.allocatorFor(wa)
 		if err != nil {
 			return err
 		}
-
-		if err := alloc.Free(list); err != nil {
+		if err := alloc.Free(start, end); err != nil {
 			return err
 		}
+		sbs.markDirty(wa)
 	}
 	return nil
 }
+
+// freeRecord releases blocks of the value and of its block trie once no
+// lease is held, prec may be nil
+func (sbs *Sbs) freeRecord(prec *pb.Record) error {
+	if prec == nil {
+		return nil
+	}
+	if prec.GetType() != pb.Record_Trie {
+		exts := recordExtents(prec)
+		for _, e := range exts {
+			// blocks of broken records are leaked, fsck finds them
+			if err := sbs.checkExtent(e); err != nil {
+				return err
+			}
+		}
+		return sbs.freeLeased(exts)
+	}
+
+	return sbs.withLease(func() error {
+		var exts []extent
+		err := sbs.walkExtents(prec, 0, func(e extent) error {
+			exts = append(exts, e)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = trie.Blocks(volumeStorage{sbs}, prec.GetTrie(), func(blk uint64) error {
+			exts = append(exts, extent{blk, 1})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return sbs.freeLeased(exts)
+	})
+}
+
+// volumeStorage gives on-disk structures access to blocks of the volume
+type volumeStorage struct {
+	sbs *Sbs
+}
+
+func (s volumeStorage) Block(n uint64) []byte {
+	off := n * consts.BlockSize
+	return s.sbs.mapping()[off : off+consts.BlockSize]
+}
+
+func (s volumeStorage) Check(n uint64, count uint64) error {
+	return s.sbs.checkExtent(extent{n, count})
+}
+
+func (s volumeStorage) Allocate(count uint64) (uint64, error) {
+	e, err := s.sbs.allocateContiguous(count)
+	if err != nil {
+		return 0, err
+	}
+	return e.start, nil
+}
+
+func (s volumeStorage) Free(n uint64, count uint64) error {
+	return s.sbs.free([]extent{{n, count}})
+}
+
+func (s volumeStorage) Flush(n uint64, count uint64) error {
+	return s.sbs.withLease(func() error {
+		return flushRange(s.sbs.mapping(), n*consts.BlockSize, (n+count)*consts.BlockSize)
+	})
+}
@@ -0,0 +1,312 @@
+package sbs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-sbs/allocator"
+	"github.com/ipfs/go-sbs/consts"
+	"github.com/ipfs/go-sbs/superblock"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// ErrRepairOnline is returned when repair is requested from a volume in use,
+// blocks of writes in progress would look leaked
+var ErrRepairOnline = fmt.Errorf("repair needs exclusive access to the volume")
+
+// FsckOptions control consistency checks
+type FsckOptions struct {
+	// Repair rebuilds bitfields of allocators from blocks referenced by the
+	// index, freeing leaked blocks and marking unallocated ones as used.
+	// It is done only by offline checks and only if every record could be
+	// read. Shared blocks are never repaired.
+	Repair bool
+
+	// Options are used to open the volume for offline checks
+	Options *Options
+}
+
+// FsckProblemKind identifies kind of inconsistency
+type FsckProblemKind string
+
+const (
+	// FsckBadSuperblock: the superblock is not valid, nothing else is checked
+	FsckBadSuperblock FsckProblemKind = "bad-superblock"
+	// FsckLegacyVolume: the volume has the layout before the superblock was
+	// introduced, it is upgraded by Open or repair. Nothing else is checked.
+	FsckLegacyVolume FsckProblemKind = "legacy-volume"
+	// FsckForeignAllocator: allocator belongs to different volume
+	FsckForeignAllocator FsckProblemKind = "foreign-allocator"
+	// FsckBadAllocator: header of an allocator doesn't match its bitfield
+	FsckBadAllocator FsckProblemKind = "bad-allocator"
+	// FsckBadRecord: record can't be read or points outside of the volume
+	FsckBadRecord FsckProblemKind = "bad-record"
+	// FsckUnallocated: referenced blocks are marked as free
+	FsckUnallocated FsckProblemKind = "unallocated"
+	// FsckShared: blocks are referenced more than once
+	FsckShared FsckProblemKind = "shared"
+	// FsckLeaked: blocks are marked as used but nothing references them
+	FsckLeaked FsckProblemKind = "leaked"
+)
+
+// FsckProblem is a single inconsistency found by Fsck
+type FsckProblem struct {
+	Kind FsckProblemKind `json:"kind"`
+	// Key of the record the problem belongs to, if any
+	Key []byte `json:"key,omitempty"`
+	// Block and Count give the affected blocks, Block is the allocator
+	// block for allocator problems
+	Block   uint64 `json:"block,omitempty"`
+	Count   uint64 `json:"count,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// FsckReport is the result of Fsck
+type FsckReport struct {
+	// Unclean is set if the volume was not closed cleanly
+	Unclean bool `json:"unclean"`
+
+	Allocators uint64 `json:"allocators"`
+	Records    uint64 `json:"records"`
+	// blocks referenced by records and by the in-volume index
+	UsedBlocks        uint64 `json:"usedBlocks"`
+	LeakedBlocks      uint64 `json:"leakedBlocks"`
+	UnallocatedBlocks uint64 `json:"unallocatedBlocks"`
+	SharedBlocks      uint64 `json:"sharedBlocks"`
+
+	Problems []FsckProblem `json:"problems,omitempty"`
+	// Repaired is set if allocators were rebuilt, volumes that were not
+	// closed cleanly are then marked as clean
+	Repaired bool `json:"repaired"`
+}
+
+// OK reports whether no problems were found
+func (r *FsckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *FsckReport) add(p FsckProblem) {
+	r.Problems = append(r.Problems, p)
+}
+
+// repairable reports whether allocators can be rebuilt from the index
+func (r *FsckReport) repairable() bool {
+	for _, p := range r.Problems {
+		switch p.Kind {
+		case FsckBadSuperblock, FsckForeignAllocator, FsckBadRecord:
+			return false
+		}
+	}
+	return true
+}
+
+// Fsck checks consistency of the volume located in path, which must not be
+// in use. Unless Repair is set the volume is opened read only and nothing is
+// written to it, legacy volumes are only reported. Volumes that were not
+// closed cleanly are not recovered when opened, they stay marked as such
+// unless they are repaired.
+func Fsck(path string, opts *FsckOptions) (*FsckReport, error) {
+	if opts == nil {
+		opts = &FsckOptions{}
+	}
+	vopts := opts.Options
+	if vopts == nil {
+		vopts = &DefaultOptions
+	}
+	datapath := filepath.Join(path, "data")
+	indexpath := filepath.Join(path, "index")
+
+	if _, err := os.Stat(datapath); err != nil {
+		return nil, err
+	}
+	sbs, _, err := openData(datapath, !opts.Repair)
+	if err != nil {
+		return nil, err
+	}
+
+	legacy := isLegacyVolume(sbs.superblockBlk(), uint64(len(sbs.mm))/consts.BlockSize)
+	if !legacy {
+		if _, err := superblock.OpenSuperblock(sbs.superblockBlk()); err != nil {
+			report := &FsckReport{}
+			report.add(FsckProblem{Kind: FsckBadSuperblock, Message: err.Error()})
+			return report, sbs.close(false)
+		}
+	}
+
+	if !opts.Repair {
+		if legacy {
+			report := &FsckReport{}
+			report.add(FsckProblem{Kind: FsckLegacyVolume})
+			return report, sbs.close(false)
+		}
+		if err := sbs.initReadOnly(indexpath, vopts); err != nil {
+			sbs.close(false)
+			return nil, err
+		}
+		report, err := sbs.fsck(false)
+		if err != nil {
+			sbs.close(false)
+			return nil, err
+		}
+		return report, sbs.close(false)
+	}
+
+	if err := sbs.init(indexpath, false, vopts, false); err != nil {
+		sbs.close(false)
+		return nil, err
+	}
+
+	report, err := sbs.fsck(true)
+	if err != nil {
+		sbs.close(false)
+		return nil, err
+	}
+	return report, sbs.close(!sbs.unclean || report.Repaired)
+}
+
+// Fsck checks consistency of the volume while it is in use. Values written
+// or deleted during the check may be reported as leaked or unallocated
+// blocks, repair is not possible.
+func (sbs *Sbs) Fsck(opts *FsckOptions) (*FsckReport, error) {
+	if opts != nil && opts.Repair {
+		return nil, ErrRepairOnline
+	}
+	return sbs.fsck(false)
+}
+
+func (sbs *Sbs) fsck(repair bool) (*FsckReport, error) {
+	report := &FsckReport{Unclean: sbs.unclean}
+
+	err := sbs.withLease(func() error {
+		_, err := superblock.OpenSuperblock(sbs.superblockBlk())
+		return err
+	})
+	if err != nil {
+		report.add(FsckProblem{Kind: FsckBadSuperblock, Message: err.Error()})
+		return report, nil
+	}
+
+	refs := make(blockSet)
+	report.Records, err = sbs.walkReferences(func(k []byte, e extent) error {
+		if err := sbs.checkExtent(e); err != nil {
+			report.add(FsckProblem{
+				Kind:    FsckBadRecord,
+				Key:     append([]byte(nil), k...),
+				Block:   e.start,
+				Count:   e.length,
+				Message: err.Error(),
+			})
+			return nil
+		}
+
+		dup := refs.add(e)
+		report.UsedBlocks += e.length - dup
+		if dup != 0 {
+			report.SharedBlocks += dup
+			report.add(FsckProblem{
+				Kind:  FsckShared,
+				Key:   append([]byte(nil), k...),
+				Block: e.start,
+				Count: e.length,
+			})
+		}
+		return nil
+	}, func(k []byte, err error) error {
+		p := FsckProblem{
+			Kind:    FsckBadRecord,
+			Key:     append([]byte(nil), k...),
+			Message: err.Error(),
+		}
+		if eerr, ok := err.(*extentError); ok {
+			p.Block, p.Count = eerr.e.start, eerr.e.length
+		}
+		report.add(p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sbs.checkAllocators(report, refs)
+
+	if repair && (sbs.unclean || !report.OK()) && report.repairable() {
+		if _, err := sbs.rebuildAllocators(refs); err != nil {
+			return nil, err
+		}
+		if err := sbs.Sync(); err != nil {
+			return nil, err
+		}
+		report.Repaired = true
+	}
+	return report, nil
+}
+
+// checkAllocators compares allocators with blocks referenced by the index
+func (sbs *Sbs) checkAllocators(report *FsckReport, refs blockSet) {
+	sbs.allocLk.Lock()
+	defer sbs.allocLk.Unlock()
+
+	report.Allocators = sbs.allocators()
+	for n := uint64(0); n < report.Allocators; n++ {
+		// allocators are opened directly, unused ones must not be formatted
+		alloc := allocator.OpenAllocator(sbs.allocatorBlk(n))
+		u := alloc.UUID()
+		switch {
+		case uuid.Equal(u, uuid.Nil):
+			// never used, it is formatted as empty when loaded
+			alloc = nil
+		case !uuid.Equal(u, sbs.sb.UUID()):
+			report.add(FsckProblem{
+				Kind:  FsckForeignAllocator,
+				Block: allocatorStart(n),
+			})
+			continue
+		default:
+			if err := alloc.Check(); err != nil {
+				report.add(FsckProblem{
+					Kind:    FsckBadAllocator,
+					Block:   allocatorStart(n),
+					Message: err.Error(),
+				})
+			}
+		}
+
+		// runs of blocks where the bitfield and the index disagree
+		var runKind FsckProblemKind
+		var runStart uint
+		flush := func(end uint) {
+			if runKind == "" {
+				return
+			}
+			count := uint64(end - runStart)
+			if runKind == FsckLeaked {
+				report.LeakedBlocks += count
+			} else {
+				report.UnallocatedBlocks += count
+			}
+			report.add(FsckProblem{
+				Kind:  runKind,
+				Block: allocatorStart(n) + uint64(runStart),
+				Count: count,
+			})
+			runKind = ""
+		}
+		for i := uint(1); i < allocator.BlocksPerAllocator; i++ {
+			used := alloc != nil && alloc.IsUsed(i)
+			var kind FsckProblemKind
+			switch ref := refs.has(n, i); {
+			case used && !ref:
+				kind = FsckLeaked
+			case ref && !used:
+				kind = FsckUnallocated
+			}
+			if kind != runKind {
+				flush(i)
+				runKind, runStart = kind, i
+			}
+		}
+		flush(allocator.BlocksPerAllocator)
+	}
+}
@@ -0,0 +1,338 @@
+package sbs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-sbs/consts"
+)
+
+func problemsOf(report *FsckReport, kind FsckProblemKind) []FsckProblem {
+	var out []FsckProblem
+	for _, p := range report.Problems {
+		if p.Kind == kind {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func TestFsck(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var used uint64
+	for i := 0; i < 10; i++ {
+		v := testValue(int64(i), i*consts.BlockSize+1)
+		if err := sbs.Put([]byte(fmt.Sprintf("key-%d", i)), v); err != nil {
+			t.Fatal(err)
+		}
+		if len(v) >= sbs.opts.InlineThreshold {
+			used += blocksNeeded(uint64(len(v)))
+		}
+	}
+
+	report, err := sbs.Fsck(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("unexpected problems: %v", report.Problems)
+	}
+	if report.Records != 10 || report.UsedBlocks != used || report.Allocators != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if _, err := sbs.Fsck(&FsckOptions{Repair: true}); err != ErrRepairOnline {
+		t.Fatalf("expected ErrRepairOnline, got: %v", err)
+	}
+
+	// leaked blocks
+	leaked, err := sbs.allocateN(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// blocks of a stored value marked as free
+	prec, err := sbs.getPB([]byte("key-4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sbs.free(recordExtents(prec)); err != nil {
+		t.Fatal(err)
+	}
+	// two keys sharing blocks
+	err = sbs.index.Update(func(tx indexTx) error {
+		return tx.Put([]byte("shared"), tx.Get([]byte("key-2")))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = Fsck(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Unclean {
+		t.Fatal("volume was closed cleanly")
+	}
+	if report.LeakedBlocks != extentsLength(leaked) {
+		t.Fatalf("expected %d leaked blocks, got %d", extentsLength(leaked), report.LeakedBlocks)
+	}
+	if p := problemsOf(report, FsckLeaked); len(p) != 1 || p[0].Block != leaked[0].start {
+		t.Fatalf("unexpected leaked problems: %v", p)
+	}
+	if report.UnallocatedBlocks != extentsLength(recordExtents(prec)) {
+		t.Fatalf("unexpected number of unallocated blocks: %d", report.UnallocatedBlocks)
+	}
+	p := problemsOf(report, FsckShared)
+	if len(p) != 1 || report.SharedBlocks != 3 {
+		t.Fatalf("unexpected shared problems: %v", p)
+	}
+	if k := string(p[0].Key); k != "key-2" && k != "shared" {
+		t.Fatalf("unexpected key of shared blocks: %s", k)
+	}
+
+	report, err = Fsck(dir, &FsckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Repaired {
+		t.Fatal("volume should have been repaired")
+	}
+
+	report, err = Fsck(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != FsckShared {
+		t.Fatalf("only shared blocks should remain, got: %v", report.Problems)
+	}
+}
+
+func TestFsckUnclean(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sbs.allocateN(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := sbs.close(false); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Fsck(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Unclean || report.LeakedBlocks != 3 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	// volume is still recovered when opened
+	sbs, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+	if stats := sbs.Recovery(); stats == nil || stats.Leaked != 3 {
+		t.Fatalf("unexpected recovery: %+v", stats)
+	}
+}
+
+func TestFsckBadSuperblock(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := Fsck(dir, nil); !os.IsNotExist(err) {
+		t.Fatalf("expected missing data file, got: %v", err)
+	}
+
+	junk := make([]byte, allocatorEnd(0)*consts.BlockSize)
+	for i := range junk {
+		junk[i] = byte(i)
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, "data"), junk, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Fsck(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != FsckBadSuperblock {
+		t.Fatalf("expected bad superblock, got: %v", report.Problems)
+	}
+}
+
+func TestFsckReadOnly(t *testing.T) {
+	for _, idx := range []IndexType{IndexBolt, IndexHamt} {
+		dir := sbsDir(t)
+		defer os.RemoveAll(dir)
+
+		sbs, err := OpenWithOptions(dir, &Options{Index: idx})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := sbs.Put([]byte(fmt.Sprintf("key-%d", i)), testValue(int64(i), i*consts.BlockSize+1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := sbs.allocateN(3); err != nil {
+			t.Fatal(err)
+		}
+		if err := sbs.close(false); err != nil {
+			t.Fatal(err)
+		}
+		// room for an allocator that was never formatted
+		if err := os.Truncate(filepath.Join(dir, "data"), int64(allocatorEnd(1)*consts.BlockSize)); err != nil {
+			t.Fatal(err)
+		}
+
+		// the superblock, allocators and the index are what open writes
+		snapshot := func() [][]byte {
+			var out [][]byte
+			f, err := os.Open(filepath.Join(dir, "data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			for _, blk := range []uint64{0, allocatorStart(0), allocatorStart(1)} {
+				b := make([]byte, consts.BlockSize)
+				if _, err := f.ReadAt(b, int64(blk*consts.BlockSize)); err != nil {
+					t.Fatal(err)
+				}
+				out = append(out, b)
+			}
+			if idx == IndexBolt {
+				b, err := ioutil.ReadFile(filepath.Join(dir, "index"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				out = append(out, b)
+			}
+			return out
+		}
+		before := snapshot()
+
+		report, err := Fsck(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.Unclean || report.LeakedBlocks != 3 || report.Records != 10 {
+			t.Fatalf("unexpected report: %+v", report)
+		}
+		for i, b := range snapshot() {
+			if !bytes.Equal(b, before[i]) {
+				t.Fatalf("index %d: part %d of the volume was modified by the check", idx, i)
+			}
+		}
+	}
+}
+
+func TestFsckLegacy(t *testing.T) {
+	rng := rng{}
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	var keys, vals [][]byte
+	for i := 0; i < 5; i++ {
+		keys = append(keys, rng.getRandKey())
+		vals = append(vals, rng.getRandBlock())
+	}
+	writeLegacyVolume(t, dir, keys, vals)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Fsck(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != FsckLegacyVolume {
+		t.Fatalf("expected legacy volume, got: %v", report.Problems)
+	}
+	after, err := ioutil.ReadFile(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, after) {
+		t.Fatal("legacy volume was modified by the check")
+	}
+
+	// repair upgrades it
+	report, err = Fsck(dir, &FsckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("unexpected problems: %v", report.Problems)
+	}
+	if report, err = Fsck(dir, nil); err != nil || !report.OK() {
+		t.Fatalf("upgraded volume should be consistent: %v %v", err, report)
+	}
+}
+
+func TestFsckOnlineHamt(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := OpenWithOptions(dir, &Options{Index: IndexHamt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	// nodes are split and rewritten while they are checked
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			if err := sbs.Put([]byte(fmt.Sprintf("key-%d", i)), testValue(int64(i), 300)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for checks := 0; checks < 20; checks++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		default:
+		}
+
+		report, err := sbs.Fsck(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range report.Problems {
+			if p.Kind != FsckLeaked && p.Kind != FsckUnallocated {
+				t.Fatalf("unexpected problem: %+v", p)
+			}
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,146 @@
+package sbs
+
+import (
+	"time"
+
+	pb "github.com/ipfs/go-sbs/pb"
+)
+
+// commitReq is a record of a Put waiting for group commit
+type commitReq struct {
+	k, data []byte
+
+	// set once the record is committed, unused is the record to free
+	unused *pb.Record
+	err    error
+	done   chan struct{}
+}
+
+// groupCommitter commits records of concurrent Puts together in one index
+// transaction. Values are written by the Put callers in parallel, only
+// the records are queued.
+type groupCommitter struct {
+	sbs *Sbs
+
+	delay time.Duration
+	size  int
+
+	reqs chan *commitReq
+	// closing is closed by stop, stopped once the queued records are
+	// committed
+	closing chan struct{}
+	stopped chan struct{}
+}
+
+func newGroupCommitter(sbs *Sbs, delay time.Duration, size int) *groupCommitter {
+	gc := &groupCommitter{
+		sbs:     sbs,
+		delay:   delay,
+		size:    size,
+		reqs:    make(chan *commitReq),
+		closing: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go gc.run()
+	return gc
+}
+
+// commit queues record data of k and waits until it is committed. Returns
+// record that is no longer referenced and whose blocks should be freed, see
+// putRecord. Fails with ErrClosed once the committer is stopped.
+func (gc *groupCommitter) commit(k, data []byte) (*pb.Record, error) {
+	req := &commitReq{k: k, data: data, done: make(chan struct{})}
+	select {
+	case gc.reqs <- req:
+	case <-gc.closing:
+		return nil, ErrClosed
+	}
+	<-req.done
+	return req.unused, req.err
+}
+
+// stop commits records queued so far and stops the committer, commits called
+// after it fail
+func (gc *groupCommitter) stop() {
+	close(gc.closing)
+	<-gc.stopped
+}
+
+func (gc *groupCommitter) run() {
+	defer close(gc.stopped)
+	for {
+		var req *commitReq
+		select {
+		case req = <-gc.reqs:
+		case <-gc.closing:
+			return
+		}
+		group := gc.collect([]*commitReq{req})
+
+		if err := gc.commitGroup(group); err != nil && len(group) > 1 {
+			// one bad record fails the whole group, commit the records
+			// one by one so only the bad one fails
+			for _, req := range group {
+				gc.commitGroup([]*commitReq{req})
+			}
+		}
+		for _, req := range group {
+			close(req.done)
+		}
+	}
+}
+
+// commitGroup commits records of the group in one index transaction, its
+// error is set on every request
+func (gc *groupCommitter) commitGroup(group []*commitReq) error {
+	err := gc.sbs.commit(false, func(tx indexTx) error {
+		for _, req := range group {
+			var err error
+			req.unused, err = gc.sbs.putRecord(tx, req.k, req.data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for _, req := range group {
+		req.err = err
+		if err != nil {
+			req.unused = nil
+		}
+	}
+	return err
+}
+
+// collect adds records queued until the group is full or it waited for
+// the commit delay, with no delay only the records already waiting are added
+func (gc *groupCommitter) collect(group []*commitReq) []*commitReq {
+	var timeout <-chan time.Time
+	if gc.delay > 0 {
+		t := time.NewTimer(gc.delay)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	for gc.size <= 0 || len(group) < gc.size {
+		if timeout == nil {
+			select {
+			case req := <-gc.reqs:
+				group = append(group, req)
+			default:
+				return group
+			}
+			continue
+		}
+
+		select {
+		case req := <-gc.reqs:
+			group = append(group, req)
+		case <-gc.closing:
+			return group
+		case <-timeout:
+			return group
+		}
+	}
+	return group
+}
@@ -0,0 +1,224 @@
+package sbs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-sbs/consts"
+)
+
+// countingIndex counts index updates
+type countingIndex struct {
+	index
+	updates int32
+}
+
+func (ci *countingIndex) Update(fn func(tx indexTx) error) error {
+	atomic.AddInt32(&ci.updates, 1)
+	return ci.index.Update(fn)
+}
+
+func testGroupCommit(t *testing.T, size int, check func(n int, updates int32)) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions
+	opts.GroupCommit = true
+	opts.CommitDelay = 20 * time.Millisecond
+	opts.CommitSize = size
+	sbs, err := OpenWithOptions(dir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci := &countingIndex{index: sbs.index}
+	sbs.index = ci
+
+	const n = 64
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			k := []byte(fmt.Sprintf("/key-%d", i))
+			errs <- sbs.Put(k, testValue(int64(i), consts.BlockSize+i))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(n, atomic.LoadInt32(&ci.updates))
+
+	sbs.index = ci.index
+	if err := sbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sbs, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+	for i := 0; i < n; i++ {
+		val, err := sbs.Get([]byte(fmt.Sprintf("/key-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(val, testValue(int64(i), consts.BlockSize+i)) {
+			t.Fatalf("value of key-%d differs", i)
+		}
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	testGroupCommit(t, 0, func(n int, updates int32) {
+		if updates >= int32(n) {
+			t.Fatalf("%d puts committed in %d transactions", n, updates)
+		}
+	})
+}
+
+func TestGroupCommitSize(t *testing.T) {
+	testGroupCommit(t, 4, func(n int, updates int32) {
+		if updates < int32(n/4) {
+			t.Fatalf("%d puts committed in %d transactions, groups too large", n, updates)
+		}
+	})
+}
+
+func TestGroupCommitOverwrite(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions
+	opts.GroupCommit = true
+	opts.CommitDelay = 20 * time.Millisecond
+	sbs, err := OpenWithOptions(dir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	k := []byte("/key")
+	if err := sbs.Put(k, testValue(0, 2*consts.BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	inUse := sbs.curAlloc.InUse()
+
+	// values replaced within one group are freed too
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := sbs.Put(k, testValue(int64(i), 2*consts.BlockSize)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if sbs.curAlloc.InUse() != inUse {
+		t.Fatalf("replaced values were not freed, %d blocks in use, expected %d",
+			sbs.curAlloc.InUse(), inUse)
+	}
+}
+
+func TestGroupCommitFailure(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions
+	opts.GroupCommit = true
+	opts.CommitDelay = 20 * time.Millisecond
+	opts.Index = IndexHamt
+	opts.InlineThreshold = 10000
+	sbs, err := OpenWithOptions(dir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+	inUse := sbs.curAlloc.InUse()
+
+	// the record of a direct value this large doesn't fit into HAMT entry,
+	// it fails only its own Put
+	const n = 16
+	var wg sync.WaitGroup
+	errs := make([]error, n+1)
+	for i := 0; i <= n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			size := 3 * consts.BlockSize
+			if i == n {
+				size = 8190
+			}
+			errs[i] = sbs.Put([]byte(fmt.Sprintf("/key-%d", i)), testValue(int64(i), size))
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatalf("key-%d: %v", i, errs[i])
+		}
+		val, err := sbs.Get([]byte(fmt.Sprintf("/key-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(val, testValue(int64(i), 3*consts.BlockSize)) {
+			t.Fatalf("value of key-%d differs", i)
+		}
+	}
+	if errs[n] == nil {
+		t.Fatal("put of too large record should fail")
+	}
+
+	// index nodes are freed together with the records
+	for i := 0; i < n; i++ {
+		if err := sbs.Delete([]byte(fmt.Sprintf("/key-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sbs.curAlloc.InUse() != inUse {
+		t.Fatalf("%d blocks in use, expected %d", sbs.curAlloc.InUse(), inUse)
+	}
+
+	// blocks of values whose records can't be committed are freed
+	idx := sbs.index
+	sbs.index = failingIndex{idx}
+	if err := sbs.Put([]byte("/failed"), testValue(0, 3*consts.BlockSize)); err == nil {
+		t.Fatal("expected put to fail")
+	}
+	sbs.index = idx
+	if sbs.curAlloc.InUse() != inUse {
+		t.Fatalf("blocks of failed put were not freed, %d in use, expected %d",
+			sbs.curAlloc.InUse(), inUse)
+	}
+}
+
+func TestGroupCommitStopped(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	gc := newGroupCommitter(sbs, 20*time.Millisecond, 0)
+	gc.stop()
+	if _, err := gc.commit([]byte("key"), []byte{}); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package hamt
+
+import (
+	"github.com/ipfs/go-sbs/consts"
+)
+
+// node block layout
+const (
+	versionStart   = 0
+	versionEnd     = versionStart + 1
+	nodeFlagsStart = versionEnd
+	nodeFlagsEnd   = nodeFlagsStart + 1
+	usedSlotsStart = nodeFlagsEnd
+	usedSlotsEnd   = usedSlotsStart + 2
+	nodeHeaderEnd  = 64
+	slotsStart     = nodeHeaderEnd
+	slotsEnd       = slotsStart + SlotCount*slotSize
+)
+
+// key record layout
+const (
+	slotFlagStart   = 0
+	slotFlagEnd     = slotFlagStart + 1
+	slotSizeStart   = slotFlagEnd
+	slotSizeEnd     = slotSizeStart + 7
+	slotRelStart    = slotSizeEnd
+	slotRelEnd      = slotRelStart + 2
+	slotOffsetStart = slotRelEnd
+	slotOffsetEnd   = slotOffsetStart + 2
+	slotSize        = slotOffsetEnd
+)
+
+// listing block layout
+const (
+	listFlagsStart = 0
+	listFlagsEnd   = listFlagsStart + 1
+	listUsedStart  = listFlagsEnd
+	listUsedEnd    = listUsedStart + 2
+	listHeadStart  = listUsedEnd
+	listHeadEnd    = listHeadStart + 2
+	listHeaderEnd  = listHeadEnd
+
+	// entry is key length, value length, key and value
+	entryHeaderSize = 4
+)
+
+const (
+	nodeVersion = 1
+
+	// SlotCount is number of key records in a node
+	SlotCount    = 1 << bitsPerLevel
+	bitsPerLevel = 9
+	// hash is 512 bits long
+	maxDepth = 512 / bitsPerLevel
+
+	// MaxEntrySize is the largest key and value pair that can be stored
+	MaxEntrySize = consts.BlockSize - listHeaderEnd
+
+	// listing block is always placed right after its node
+	listingRel = 1
+	// NodeBlocks is number of blocks taken by a node and its listing
+	NodeBlocks = 2
+)
+
+// key record flags
+const (
+	slotEmpty = 0
+	slotTiny  = 1
+	slotShard = 5
+)
+
+// listing flags
+const (
+	listFragmented = 1 << iota
+)
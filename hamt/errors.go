@@ -0,0 +1,11 @@
+package hamt
+
+import (
+	errors "github.com/juju/errors"
+)
+
+var (
+	ErrWrongVersion  = errors.New("HAMT node version is not 1")
+	ErrEntryTooLarge = errors.New("key and value too large for HAMT entry")
+	ErrTooDeep       = errors.New("HAMT reached maximum depth")
+)
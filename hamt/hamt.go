@@ -0,0 +1,372 @@
+package hamt
+
+import (
+	"bytes"
+	binenc "encoding/binary"
+	"sort"
+
+	"github.com/ipfs/go-sbs/storage"
+
+	errors "github.com/juju/errors"
+	"golang.org/x/crypto/blake2b"
+)
+
+var (
+	binary binenc.ByteOrder = binenc.LittleEndian
+)
+
+// Hamt is a hash array mapped trie of key records stored in 8k blocks.
+// Keys are hashed with Blake2b-512, each level of the trie consumes 9 bits
+// of the hash. Every node is followed by a listing block holding keys and
+// values of entries in the node.
+//
+// A new node is flushed before a parent points to it and a parent is flushed
+// once it no longer points to a node being freed, so shard pointers reaching
+// the storage first never lead to a node that wasn't written. Other changes
+// are kept in memory until Flush.
+type Hamt struct {
+	s    storage.Storage
+	root node
+	// dirty holds blocks changed since the last Flush
+	dirty map[uint64]struct{}
+}
+
+// Create allocates new empty HAMT
+func Create(s storage.Storage) (*Hamt, error) {
+	h := &Hamt{
+		s:     s,
+		dirty: make(map[uint64]struct{}),
+	}
+	root, err := newNode(s, h.dirty)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := h.flushNode(root); err != nil {
+		return nil, err
+	}
+	h.root = root
+	return h, nil
+}
+
+// Open opens HAMT with root node at block root
+func Open(s storage.Storage, root uint64) (*Hamt, error) {
+	h := &Hamt{
+		s:     s,
+		dirty: make(map[uint64]struct{}),
+	}
+	n, err := h.openNode(root)
+	if err != nil {
+		return nil, err
+	}
+	h.root = n
+	return h, nil
+}
+
+func (h *Hamt) openNode(blk uint64) (node, error) {
+	return openNode(h.s, blk, h.dirty)
+}
+
+// flushNode writes out both blocks of node n
+func (h *Hamt) flushNode(n node) error {
+	return h.flush(n.blk, NodeBlocks)
+}
+
+func (h *Hamt) flush(blk, count uint64) error {
+	if err := h.s.Flush(blk, count); err != nil {
+		return errors.Trace(err)
+	}
+	for b := blk; b < blk+count; b++ {
+		delete(h.dirty, b)
+	}
+	return nil
+}
+
+// Flush writes out blocks of all nodes changed since the last Flush
+func (h *Hamt) Flush() error {
+	blks := make([]uint64, 0, len(h.dirty))
+	for blk := range h.dirty {
+		blks = append(blks, blk)
+	}
+	sort.Slice(blks, func(i, j int) bool { return blks[i] < blks[j] })
+
+	// adjacent blocks are flushed together
+	for i := 0; i < len(blks); {
+		j := i + 1
+		for j < len(blks) && blks[j] == blks[j-1]+1 {
+			j++
+		}
+		if err := h.flush(blks[i], uint64(j-i)); err != nil {
+			return err
+		}
+		i = j
+	}
+	return nil
+}
+
+// Root returns block index of the root node
+func (h *Hamt) Root() uint64 {
+	return h.root.blk
+}
+
+type hash [blake2b.Size]byte
+
+func hashKey(k []byte) hash {
+	return blake2b.Sum512(k)
+}
+
+// index returns slot index of the hash at given depth
+func (h *hash) index(depth uint) uint {
+	var v uint
+	for b := depth * bitsPerLevel; b < (depth+1)*bitsPerLevel; b++ {
+		v = v<<1 | uint(h[b/8]>>(7-b%8))&1
+	}
+	return v
+}
+
+// Get returns value stored under k or nil, it is valid until HAMT is modified
+func (h *Hamt) Get(k []byte) ([]byte, error) {
+	hk := hashKey(k)
+	n := h.root
+	for depth := uint(0); depth < maxDepth; depth++ {
+		sl := n.slot(hk.index(depth))
+		switch sl.flag {
+		case slotShard:
+			var err error
+			if n, err = h.openNode(sl.size); err != nil {
+				return nil, err
+			}
+		case slotTiny:
+			ek, ev := n.entry(sl)
+			if bytes.Equal(ek, k) {
+				return ev, nil
+			}
+			return nil, nil
+		default:
+			return nil, nil
+		}
+	}
+	return nil, errors.Trace(ErrTooDeep)
+}
+
+// CheckEntry returns ErrEntryTooLarge if key k with value v can't be stored
+func CheckEntry(k, v []byte) error {
+	if entrySize(k, v) > MaxEntrySize {
+		return errors.Trace(ErrEntryTooLarge)
+	}
+	return nil
+}
+
+// Put stores value v under key k, replacing previous value
+func (h *Hamt) Put(k, v []byte) error {
+	if err := CheckEntry(k, v); err != nil {
+		return err
+	}
+
+	hk := hashKey(k)
+	n := h.root
+	for depth := uint(0); depth < maxDepth; depth++ {
+		i := hk.index(depth)
+		sl := n.slot(i)
+		switch sl.flag {
+		case slotShard:
+			var err error
+			if n, err = h.openNode(sl.size); err != nil {
+				return err
+			}
+		case slotTiny:
+			ek, ev := n.entry(sl)
+			if bytes.Equal(ek, k) {
+				n.removeEntry(i)
+				return h.insert(n, i, depth, k, v)
+			}
+
+			// slot is taken by other key, move it one level down
+			ek = append([]byte{}, ek...)
+			ev = append([]byte{}, ev...)
+			child, err := h.pushDown(n, i, depth, ek, ev)
+			if err != nil {
+				return err
+			}
+			n = child
+		default:
+			return h.insert(n, i, depth, k, v)
+		}
+	}
+	return errors.Trace(ErrTooDeep)
+}
+
+// insert puts entry into empty slot i of node n, making space in the listing
+// by moving other entries to child nodes
+func (h *Hamt) insert(n node, i, depth uint, k, v []byte) error {
+	size := entrySize(k, v)
+	for !n.fits(size) {
+		// move the largest entry down
+		var j uint
+		var jsize uint64
+		for s := uint(0); s < SlotCount; s++ {
+			sl := n.slot(s)
+			if s != i && sl.flag == slotTiny && sl.size > jsize {
+				j, jsize = s, sl.size
+			}
+		}
+		if jsize == 0 {
+			return errors.Trace(ErrEntryTooLarge)
+		}
+
+		ek, ev := n.entry(n.slot(j))
+		ek = append([]byte{}, ek...)
+		ev = append([]byte{}, ev...)
+		if _, err := h.pushDown(n, j, depth, ek, ev); err != nil {
+			return err
+		}
+	}
+
+	n.addEntry(i, k, v)
+	return nil
+}
+
+// pushDown replaces entry (ek, ev) in slot i with a child node holding it
+func (h *Hamt) pushDown(n node, i, depth uint, ek, ev []byte) (node, error) {
+	if depth+1 >= maxDepth {
+		return node{}, errors.Trace(ErrTooDeep)
+	}
+
+	child, err := newNode(h.s, h.dirty)
+	if err != nil {
+		return node{}, errors.Trace(err)
+	}
+	hk := hashKey(ek)
+	child.addEntry(hk.index(depth+1), ek, ev)
+	if err := h.flushNode(child); err != nil {
+		h.s.Free(child.blk, NodeBlocks)
+		return node{}, err
+	}
+
+	n.removeEntry(i)
+	n.setShard(i, child)
+	return child, nil
+}
+
+// Delete removes key k, nodes left empty are freed
+func (h *Hamt) Delete(k []byte) error {
+	hk := hashKey(k)
+
+	type step struct {
+		n node
+		i uint
+	}
+	var path []step
+
+	n := h.root
+	for depth := uint(0); depth < maxDepth; depth++ {
+		i := hk.index(depth)
+		sl := n.slot(i)
+		switch sl.flag {
+		case slotShard:
+			path = append(path, step{n, i})
+			var err error
+			if n, err = h.openNode(sl.size); err != nil {
+				return err
+			}
+			continue
+		case slotTiny:
+			ek, _ := n.entry(sl)
+			if !bytes.Equal(ek, k) {
+				return nil
+			}
+			n.removeEntry(i)
+		default:
+			return nil
+		}
+
+		for l := len(path) - 1; l >= 0 && n.usedSlots() == 0; l-- {
+			p := path[l].n
+			p.clearShard(path[l].i)
+			if err := h.flush(p.blk, 1); err != nil {
+				return err
+			}
+			if err := h.s.Free(n.blk, NodeBlocks); err != nil {
+				return errors.Trace(err)
+			}
+			delete(h.dirty, n.blk)
+			delete(h.dirty, n.blk+listingRel)
+			n = p
+		}
+		return nil
+	}
+	return errors.Trace(ErrTooDeep)
+}
+
+// ForEach calls fn for every entry in the order of key hashes, starting after
+// key after (from the first entry if after is nil). Iteration stops at first
+// error returned by fn. HAMT must not be modified during iteration.
+func (h *Hamt) ForEach(after []byte, fn func(k, v []byte) error) error {
+	var ha *hash
+	if after != nil {
+		hk := hashKey(after)
+		ha = &hk
+	}
+	return h.walk(h.root, 0, ha, fn)
+}
+
+func (h *Hamt) walk(n node, depth uint, after *hash, fn func(k, v []byte) error) error {
+	start := uint(0)
+	if after != nil {
+		start = after.index(depth)
+	}
+
+	for i := start; i < SlotCount; i++ {
+		var bound *hash
+		if i == start {
+			bound = after
+		}
+
+		sl := n.slot(i)
+		switch sl.flag {
+		case slotShard:
+			child, err := h.openNode(sl.size)
+			if err != nil {
+				return err
+			}
+			if err := h.walk(child, depth+1, bound, fn); err != nil {
+				return err
+			}
+		case slotTiny:
+			k, v := n.entry(sl)
+			if bound != nil {
+				hk := hashKey(k)
+				if bytes.Compare(hk[:], bound[:]) <= 0 {
+					continue
+				}
+			}
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ForEachNode calls fn with the first block of every node, each node takes
+// NodeBlocks blocks
+func (h *Hamt) ForEachNode(fn func(blk uint64) error) error {
+	var walk func(n node) error
+	walk = func(n node) error {
+		if err := fn(n.blk); err != nil {
+			return err
+		}
+		for i := uint(0); i < SlotCount; i++ {
+			if sl := n.slot(i); sl.flag == slotShard {
+				child, err := h.openNode(sl.size)
+				if err != nil {
+					return err
+				}
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(h.root)
+}
@@ -0,0 +1,196 @@
+package hamt
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/ipfs/go-sbs/internal/storagetest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tKey(i int) []byte {
+	return []byte(fmt.Sprintf("key-%d", i))
+}
+
+func tVal(i int) []byte {
+	return bytes.Repeat([]byte{byte(i)}, 20+i%100)
+}
+
+func TestPutGet(t *testing.T) {
+	h, err := Create(storagetest.NewMem())
+	assert.NoError(t, err, "create should not fail")
+
+	assert.NoError(t, h.Put([]byte("foo"), []byte("bar")), "put should not fail")
+	v, err := h.Get([]byte("foo"))
+	assert.NoError(t, err, "get should not fail")
+	assert.Equal(t, []byte("bar"), v, "should get stored value")
+
+	v, err = h.Get([]byte("baz"))
+	assert.NoError(t, err, "get should not fail")
+	assert.Nil(t, v, "missing key should return nil")
+
+	assert.NoError(t, h.Put([]byte("foo"), []byte("overwritten")), "put should not fail")
+	v, err = h.Get([]byte("foo"))
+	assert.NoError(t, err, "get should not fail")
+	assert.Equal(t, []byte("overwritten"), v, "value should be replaced")
+}
+
+func TestManyKeys(t *testing.T) {
+	s := storagetest.NewMem()
+	h, err := Create(s)
+	assert.NoError(t, err, "create should not fail")
+
+	const count = 20000
+	for i := 0; i < count; i++ {
+		if err := h.Put(tKey(i), tVal(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.True(t, s.InUse() > NodeBlocks, "keys should not fit into root")
+
+	h, err = Open(s, h.Root())
+	assert.NoError(t, err, "open should not fail")
+	for i := 0; i < count; i++ {
+		v, err := h.Get(tKey(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, tVal(i)) {
+			t.Fatalf("wrong value for key %d", i)
+		}
+	}
+
+	for i := 0; i < count; i += 2 {
+		if err := h.Delete(tKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < count; i++ {
+		v, err := h.Get(tKey(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 && v != nil {
+			t.Fatalf("key %d should be deleted", i)
+		}
+		if i%2 == 1 && !bytes.Equal(v, tVal(i)) {
+			t.Fatalf("wrong value for key %d", i)
+		}
+	}
+
+	for i := 1; i < count; i += 2 {
+		if err := h.Delete(tKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, NodeBlocks, s.InUse(), "only root should be left")
+}
+
+func TestForEach(t *testing.T) {
+	h, err := Create(storagetest.NewMem())
+	assert.NoError(t, err, "create should not fail")
+
+	const count = 5000
+	for i := 0; i < count; i++ {
+		if err := h.Put(tKey(i), tVal(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []string
+	err = h.ForEach(nil, func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+	assert.NoError(t, err, "for each should not fail")
+	assert.Len(t, keys, count, "every key should be visited")
+	assert.True(t, sort.SliceIsSorted(keys, func(i, j int) bool {
+		hi, hj := hashKey([]byte(keys[i])), hashKey([]byte(keys[j]))
+		return bytes.Compare(hi[:], hj[:]) < 0
+	}), "keys should be in order of hashes")
+
+	var rest []string
+	err = h.ForEach([]byte(keys[1000]), func(k, v []byte) error {
+		rest = append(rest, string(k))
+		return nil
+	})
+	assert.NoError(t, err, "for each should not fail")
+	assert.Equal(t, keys[1001:], rest, "should resume after given key")
+
+	stop := fmt.Errorf("stop")
+	n := 0
+	err = h.ForEach(nil, func(k, v []byte) error {
+		n++
+		if n == 10 {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(t, stop, err, "error from callback should be returned")
+	assert.Equal(t, 10, n, "iteration should stop")
+}
+
+func TestLargeEntries(t *testing.T) {
+	h, err := Create(storagetest.NewMem())
+	assert.NoError(t, err, "create should not fail")
+
+	big := make([]byte, MaxEntrySize-entryHeaderSize-10)
+	for i := 0; i < 20; i++ {
+		k := []byte(fmt.Sprintf("k%08d", i))
+		if err := h.Put(k, big); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		k := []byte(fmt.Sprintf("k%08d", i))
+		v, err := h.Get(k)
+		assert.NoError(t, err, "get should not fail")
+		assert.Equal(t, big, v, "value should be stored")
+	}
+
+	err = h.Put([]byte("toolarge"), make([]byte, MaxEntrySize))
+	assert.EqualError(t, err, ErrEntryTooLarge.Error(), "too large entry should fail")
+}
+
+func TestOpenWrongVersion(t *testing.T) {
+	s := storagetest.NewMem()
+	blk, _ := s.Allocate(NodeBlocks)
+
+	_, err := Open(s, blk)
+	assert.EqualError(t, err, ErrWrongVersion.Error(), "unformatted node should fail")
+}
+
+func TestFlushOrder(t *testing.T) {
+	s := storagetest.NewMem()
+	h, err := Create(s)
+	assert.NoError(t, err, "create should not fail")
+
+	const count = 3000
+	for i := 0; i < count; i++ {
+		if err := h.Put(tKey(i), tVal(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// crash with all changes but blocks never flushed on the disk, nodes
+	// reachable from the root must have been written
+	crashed := storagetest.NewMem()
+	for i, b := range s.Blks {
+		blk := make([]byte, len(b))
+		if s.Flushed[uint64(i)] {
+			copy(blk, b)
+		}
+		crashed.Blks = append(crashed.Blks, blk)
+	}
+	ch, err := Open(crashed, h.Root())
+	assert.NoError(t, err, "open after crash should not fail")
+	err = ch.ForEachNode(func(blk uint64) error { return nil })
+	assert.NoError(t, err, "nodes should be readable after crash")
+
+	assert.NotEmpty(t, h.dirty, "changes should be kept until flush")
+	assert.NoError(t, h.Flush(), "flush should not fail")
+	assert.Empty(t, h.dirty, "no block should be left dirty")
+}
@@ -0,0 +1,233 @@
+package hamt
+
+import (
+	"github.com/ipfs/go-sbs/consts"
+	"github.com/ipfs/go-sbs/storage"
+
+	errors "github.com/juju/errors"
+)
+
+// node gives access to HAMT node and its listing block. Blocks are fetched
+// from the storage on every access as they move when storage grows, blocks
+// written to are added to dirty.
+type node struct {
+	s     storage.Storage
+	blk   uint64
+	dirty map[uint64]struct{}
+}
+
+// slot is a key record, for slotTiny size is length of the entry stored at
+// offset in the listing block, for slotShard size is the block of child node
+type slot struct {
+	flag byte
+	size uint64
+	rel  uint16
+	off  uint16
+}
+
+func (n node) format() {
+	d := n.mdata()
+	for i := range d {
+		d[i] = 0
+	}
+	d[versionStart] = nodeVersion
+
+	l := n.mlisting()
+	for i := range l {
+		l[i] = 0
+	}
+	binary.PutUint16(l[listHeadStart:listHeadEnd], listHeaderEnd)
+}
+
+// newNode allocates and formats new empty node
+func newNode(s storage.Storage, dirty map[uint64]struct{}) (node, error) {
+	blk, err := s.Allocate(NodeBlocks)
+	if err != nil {
+		return node{}, err
+	}
+	n := node{s, blk, dirty}
+	n.format()
+	return n, nil
+}
+
+// openNode returns node at block blk read from the storage
+func openNode(s storage.Storage, blk uint64, dirty map[uint64]struct{}) (node, error) {
+	if err := s.Check(blk, NodeBlocks); err != nil {
+		return node{}, errors.Trace(err)
+	}
+	n := node{s, blk, dirty}
+	if n.version() != nodeVersion {
+		return node{}, errors.Trace(ErrWrongVersion)
+	}
+	return n, nil
+}
+
+func (n node) data() []byte {
+	return n.s.Block(n.blk)
+}
+
+func (n node) listing() []byte {
+	return n.s.Block(n.blk + listingRel)
+}
+
+// mdata returns the node block to be modified
+func (n node) mdata() []byte {
+	n.dirty[n.blk] = struct{}{}
+	return n.data()
+}
+
+// mlisting returns the listing block to be modified
+func (n node) mlisting() []byte {
+	n.dirty[n.blk+listingRel] = struct{}{}
+	return n.listing()
+}
+
+func (n node) version() byte {
+	return n.data()[versionStart]
+}
+
+func (n node) usedSlots() uint {
+	return uint(binary.Uint16(n.data()[usedSlotsStart:usedSlotsEnd]))
+}
+
+func (n node) setUsedSlots(u uint) {
+	binary.PutUint16(n.mdata()[usedSlotsStart:usedSlotsEnd], uint16(u))
+}
+
+func (n node) slot(i uint) slot {
+	off := slotsStart + i*slotSize
+	rec := n.data()[off : off+slotSize]
+
+	var size [8]byte
+	copy(size[:], rec[slotSizeStart:slotSizeEnd])
+	return slot{
+		flag: rec[slotFlagStart],
+		size: binary.Uint64(size[:]),
+		rel:  binary.Uint16(rec[slotRelStart:slotRelEnd]),
+		off:  binary.Uint16(rec[slotOffsetStart:slotOffsetEnd]),
+	}
+}
+
+func (n node) setSlot(i uint, sl slot) {
+	off := slotsStart + i*slotSize
+	rec := n.mdata()[off : off+slotSize]
+
+	var size [8]byte
+	binary.PutUint64(size[:], sl.size)
+	rec[slotFlagStart] = sl.flag
+	copy(rec[slotSizeStart:slotSizeEnd], size[:])
+	binary.PutUint16(rec[slotRelStart:slotRelEnd], sl.rel)
+	binary.PutUint16(rec[slotOffsetStart:slotOffsetEnd], sl.off)
+}
+
+func (n node) listUsed() uint {
+	return uint(binary.Uint16(n.listing()[listUsedStart:listUsedEnd]))
+}
+
+func (n node) listHead() uint {
+	return uint(binary.Uint16(n.listing()[listHeadStart:listHeadEnd]))
+}
+
+func (n node) setList(used, head uint) {
+	l := n.mlisting()
+	binary.PutUint16(l[listUsedStart:listUsedEnd], uint16(used))
+	binary.PutUint16(l[listHeadStart:listHeadEnd], uint16(head))
+}
+
+func entrySize(k, v []byte) uint {
+	return uint(entryHeaderSize + len(k) + len(v))
+}
+
+// entry returns key and value of a slotTiny record, both point into listing
+func (n node) entry(sl slot) ([]byte, []byte) {
+	e := n.listing()[sl.off : uint64(sl.off)+sl.size]
+	klen := binary.Uint16(e[0:2])
+	vlen := binary.Uint16(e[2:4])
+	k := e[entryHeaderSize : entryHeaderSize+klen]
+	return k, e[entryHeaderSize+klen : entryHeaderSize+klen+vlen]
+}
+
+// fits reports whether entry of given size can be added to the listing
+func (n node) fits(size uint) bool {
+	return n.listUsed()+size <= MaxEntrySize
+}
+
+// addEntry stores entry in the listing and puts its record in slot i. It has
+// to fit into the listing.
+func (n node) addEntry(i uint, k, v []byte) {
+	size := entrySize(k, v)
+	if n.listHead()+size > consts.BlockSize {
+		n.compact()
+	}
+
+	head := n.listHead()
+	e := n.mlisting()[head : head+size]
+	binary.PutUint16(e[0:2], uint16(len(k)))
+	binary.PutUint16(e[2:4], uint16(len(v)))
+	copy(e[entryHeaderSize:], k)
+	copy(e[entryHeaderSize+uint(len(k)):], v)
+	n.setList(n.listUsed()+size, head+size)
+
+	n.setSlot(i, slot{
+		flag: slotTiny,
+		size: uint64(size),
+		rel:  listingRel,
+		off:  uint16(head),
+	})
+	n.setUsedSlots(n.usedSlots() + 1)
+}
+
+// removeEntry clears slot i holding an entry
+func (n node) removeEntry(i uint) {
+	sl := n.slot(i)
+	n.setSlot(i, slot{})
+	n.setUsedSlots(n.usedSlots() - 1)
+
+	l := n.mlisting()
+	used := n.listUsed() - uint(sl.size)
+	if uint(sl.off)+uint(sl.size) == n.listHead() {
+		// last entry, just move the head back
+		n.setList(used, uint(sl.off))
+		return
+	}
+	l[listFlagsStart] |= listFragmented
+	n.setList(used, n.listHead())
+}
+
+// compact moves all entries to the beginning of listing, removing holes
+// left after removed entries
+func (n node) compact() {
+	l := n.mlisting()
+	buf := make([]byte, consts.BlockSize)
+	head := uint(listHeaderEnd)
+
+	for i := uint(0); i < SlotCount; i++ {
+		sl := n.slot(i)
+		if sl.flag != slotTiny {
+			continue
+		}
+		copy(buf[head:], l[sl.off:uint64(sl.off)+sl.size])
+		sl.off = uint16(head)
+		n.setSlot(i, sl)
+		head += uint(sl.size)
+	}
+
+	copy(l[listHeaderEnd:], buf[listHeaderEnd:])
+	l[listFlagsStart] &^= listFragmented
+	n.setList(head-listHeaderEnd, head)
+}
+
+// setShard makes slot i point to child node
+func (n node) setShard(i uint, child node) {
+	n.setSlot(i, slot{
+		flag: slotShard,
+		size: child.blk,
+	})
+	n.setUsedSlots(n.usedSlots() + 1)
+}
+
+// clearShard removes child pointer from slot i
+func (n node) clearShard(i uint) {
+	n.setSlot(i, slot{})
+	n.setUsedSlots(n.usedSlots() - 1)
+}
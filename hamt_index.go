@@ -0,0 +1,222 @@
+package sbs
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-sbs/hamt"
+)
+
+var errTxReadOnly = fmt.Errorf("index transaction is read only")
+
+// Records and meta records share one HAMT, keys are prefixed with a table byte
+const (
+	hamtRecords = 0
+	hamtMeta    = 1
+)
+
+func hamtKey(table byte, k []byte) []byte {
+	return append([]byte{table}, k...)
+}
+
+// hamtIndex keeps records in a HAMT inside the volume. Writes of a transaction
+// are buffered and applied when it commits, they are not atomic in case of
+// a crash.
+type hamtIndex struct {
+	sbs *Sbs
+
+	lk sync.RWMutex
+	h  *hamt.Hamt
+}
+
+func createHamtIndex(sbs *Sbs) (*hamtIndex, error) {
+	h, err := hamt.Create(volumeStorage{sbs})
+	if err != nil {
+		return nil, err
+	}
+	return &hamtIndex{sbs: sbs, h: h}, nil
+}
+
+func openHamtIndex(sbs *Sbs, root uint64) (*hamtIndex, error) {
+	h, err := hamt.Open(volumeStorage{sbs}, root)
+	if err != nil {
+		return nil, err
+	}
+	return &hamtIndex{sbs: sbs, h: h}, nil
+}
+
+// nodes are read directly from the mapped data file, transactions hold
+// a lease so the mapping stays valid while the volume grows
+
+func (hi *hamtIndex) View(fn func(tx indexTx) error) error {
+	hi.lk.RLock()
+	defer hi.lk.RUnlock()
+
+	return hi.sbs.withLease(func() error {
+		return fn(&hamtTx{h: hi.h})
+	})
+}
+
+func (hi *hamtIndex) Update(fn func(tx indexTx) error) error {
+	hi.lk.Lock()
+	defer hi.lk.Unlock()
+
+	return hi.sbs.withLease(func() error {
+		tx := &hamtTx{
+			h:       hi.h,
+			pending: make(map[string][]byte),
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := tx.commit(); err != nil {
+			return err
+		}
+		if hi.sbs.opts.Sync == SyncAlways {
+			return hi.h.Flush()
+		}
+		return nil
+	})
+}
+
+// Sync flushes nodes changed since the last Sync
+func (hi *hamtIndex) Sync() error {
+	hi.lk.Lock()
+	defer hi.lk.Unlock()
+
+	return hi.sbs.withLease(hi.h.Flush)
+}
+
+func (hi *hamtIndex) Close() error {
+	return nil
+}
+
+type hamtTx struct {
+	h *hamt.Hamt
+
+	// pending is nil for read only transactions, deleted keys map to nil
+	pending map[string][]byte
+	order   []string
+}
+
+func (t *hamtTx) get(k []byte) []byte {
+	if v, ok := t.pending[string(k)]; ok {
+		return v
+	}
+	v, err := t.h.Get(k)
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+func (t *hamtTx) put(k, v []byte) error {
+	if t.pending == nil {
+		return errTxReadOnly
+	}
+	if _, ok := t.pending[string(k)]; !ok {
+		t.order = append(t.order, string(k))
+	}
+	if v != nil {
+		v = append([]byte{}, v...)
+	}
+	t.pending[string(k)] = v
+	return nil
+}
+
+// commit applies pending writes as a whole or not at all. Entries too large
+// are refused before the HAMT is touched, writes applied before any other
+// error are undone.
+func (t *hamtTx) commit() error {
+	for _, k := range t.order {
+		if v := t.pending[k]; v != nil {
+			if err := hamt.CheckEntry([]byte(k), v); err != nil {
+				return err
+			}
+		}
+	}
+
+	prev := make(map[string][]byte, len(t.order))
+	for i, k := range t.order {
+		v, err := t.h.Get([]byte(k))
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			v = append([]byte{}, v...)
+		}
+		prev[k] = v
+
+		if v := t.pending[k]; v != nil {
+			err = t.h.Put([]byte(k), v)
+		} else {
+			err = t.h.Delete([]byte(k))
+		}
+		if err != nil {
+			t.rollback(t.order[:i+1], prev)
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback restores previous values of keys in reverse order. Its errors are
+// dropped, the commit is failing with the first one anyway.
+func (t *hamtTx) rollback(keys []string, prev map[string][]byte) {
+	for i := len(keys) - 1; i >= 0; i-- {
+		k := keys[i]
+		if v := prev[k]; v != nil {
+			t.h.Put([]byte(k), v)
+		} else {
+			t.h.Delete([]byte(k))
+		}
+	}
+}
+
+func (t *hamtTx) Get(k []byte) []byte {
+	return t.get(hamtKey(hamtRecords, k))
+}
+
+func (t *hamtTx) Put(k, v []byte) error {
+	return t.put(hamtKey(hamtRecords, k), v)
+}
+
+func (t *hamtTx) Delete(k []byte) error {
+	return t.put(hamtKey(hamtRecords, k), nil)
+}
+
+// ForEach iterates in the order of key hashes, prefix is matched against every
+// key. Records written in the same transaction are visited only if they
+// replace existing ones.
+func (t *hamtTx) ForEach(prefix, after []byte, fn func(k, v []byte) error) error {
+	var hafter []byte
+	if after != nil {
+		hafter = hamtKey(hamtRecords, after)
+	}
+
+	return t.h.ForEach(hafter, func(hk, v []byte) error {
+		if hk[0] != hamtRecords || !bytes.HasPrefix(hk[1:], prefix) {
+			return nil
+		}
+		if pv, ok := t.pending[string(hk)]; ok {
+			if pv == nil {
+				return nil
+			}
+			v = pv
+		}
+		return fn(hk[1:], v)
+	})
+}
+
+func (t *hamtTx) GetMeta(k []byte) []byte {
+	return t.get(hamtKey(hamtMeta, k))
+}
+
+func (t *hamtTx) PutMeta(k, v []byte) error {
+	return t.put(hamtKey(hamtMeta, k), v)
+}
+
+func (t *hamtTx) DeleteMeta(k []byte) error {
+	return t.put(hamtKey(hamtMeta, k), nil)
+}
@@ -0,0 +1,161 @@
+package sbs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-sbs/consts"
+	"github.com/ipfs/go-sbs/superblock"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestHamtIndex(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := OpenWithOptions(dir, &Options{Index: IndexHamt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := make(map[string][]byte)
+	for i := 0; i < 2000; i++ {
+		k := []byte(fmt.Sprintf("key-%d", i))
+		v := testValue(int64(i), 100+i*7)
+		if err := sbs.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+		vals[string(k)] = v
+	}
+	for i := 0; i < 2000; i += 3 {
+		k := []byte(fmt.Sprintf("key-%d", i))
+		if err := sbs.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+		delete(vals, string(k))
+	}
+	if err := sbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "index")); !os.IsNotExist(err) {
+		t.Fatal("bolt index should not be created")
+	}
+
+	// options of existing volume are ignored
+	sbs, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	if sbs.sb.Flags()&superblock.FlagHamtIndex == 0 {
+		t.Fatal("volume should be marked as using HAMT index")
+	}
+
+	if _, err := sbs.Defragment(context.Background(), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2000; i++ {
+		k := []byte(fmt.Sprintf("key-%d", i))
+		v, ok := vals[string(k)]
+
+		has, err := sbs.Has(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has != ok {
+			t.Fatalf("Has(%s) = %t, expected %t", k, has, ok)
+		}
+		if !ok {
+			continue
+		}
+
+		out, err := sbs.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, v) {
+			t.Fatalf("value of %s differs", k)
+		}
+	}
+}
+
+func TestHamtIndexAtomicCommit(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := OpenWithOptions(dir, &Options{Index: IndexHamt, InlineThreshold: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	if err := sbs.Put([]byte("/old"), testValue(0, 100)); err != nil {
+		t.Fatal(err)
+	}
+	inUse := sbs.curAlloc.InUse()
+
+	fs := &Sbsds{sbs: sbs}
+	b, err := fs.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		err := b.Put(ds.NewKey(fmt.Sprintf("/key-%d", i)), testValue(int64(i), 3*consts.BlockSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Delete(ds.NewKey("/old")); err != nil {
+		t.Fatal(err)
+	}
+	// the record of a direct value this large doesn't fit into HAMT entry
+	if err := b.Put(ds.NewKey("/large"), testValue(5, 8190)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err == nil {
+		t.Fatal("batch with too large entry should fail")
+	}
+
+	for i := 0; i < 5; i++ {
+		if has, err := sbs.Has([]byte(fmt.Sprintf("/key-%d", i))); err != nil || has {
+			t.Fatalf("key-%d should not be stored: %v", i, err)
+		}
+	}
+	if has, err := sbs.Has([]byte("/old")); err != nil || !has {
+		t.Fatalf("old should not be deleted: %v", err)
+	}
+	if sbs.curAlloc.InUse() != inUse {
+		t.Fatalf("%d blocks in use, expected %d", sbs.curAlloc.InUse(), inUse)
+	}
+
+	// writes before the failing one are not applied
+	err = sbs.index.Update(func(tx indexTx) error {
+		if err := tx.Put([]byte("/first"), []byte("record")); err != nil {
+			return err
+		}
+		if err := tx.Delete([]byte("/old")); err != nil {
+			return err
+		}
+		return tx.Put([]byte("/large"), testValue(6, consts.BlockSize))
+	})
+	if err == nil {
+		t.Fatal("transaction with too large entry should fail")
+	}
+	err = sbs.index.View(func(tx indexTx) error {
+		if tx.Get([]byte("/first")) != nil || tx.Get([]byte("/old")) == nil {
+			t.Fatal("failed transaction was partially applied")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,172 @@
+package sbs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+// IndexType selects where records of values are kept
+type IndexType int
+
+const (
+	// IndexBolt keeps records in a bolt database next to the data file
+	IndexBolt IndexType = iota
+	// IndexHamt keeps records in a HAMT inside the data volume
+	IndexHamt
+)
+
+var (
+	bucketOffset = []byte("offsets")
+	bucketMeta   = []byte("meta")
+)
+
+// errStopIteration is returned from ForEach callbacks to end iteration early
+var errStopIteration = fmt.Errorf("stop iteration")
+
+// index maps keys to serialized records
+type index interface {
+	View(fn func(tx indexTx) error) error
+	Update(fn func(tx indexTx) error) error
+	// Sync makes committed transactions durable
+	Sync() error
+	Close() error
+}
+
+// indexTx is a transaction on the index. Slices returned by or passed from
+// it are valid only until the transaction ends.
+type indexTx interface {
+	Get(k []byte) []byte
+	Put(k, v []byte) error
+	Delete(k []byte) error
+
+	// ForEach calls fn for records with keys starting with prefix, in the
+	// order of the index, starting after key after (from the beginning if
+	// it is nil). Iteration stops at first error returned by fn. The index
+	// must not be modified from fn.
+	ForEach(prefix, after []byte, fn func(k, v []byte) error) error
+
+	// Meta records are kept apart from records of values
+	GetMeta(k []byte) []byte
+	PutMeta(k, v []byte) error
+	DeleteMeta(k []byte) error
+}
+
+type boltIndex struct {
+	db *bolt.DB
+}
+
+// openBoltIndex opens bolt database at path, with noSync commits are made
+// durable only by Sync
+func openBoltIndex(path string, noSync bool) (*boltIndex, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	db.NoSync = noSync
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketOffset); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketMeta)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltIndex{db}, nil
+}
+
+// openBoltIndexReadOnly opens existing index, it can only be viewed
+func openBoltIndexReadOnly(path string) (*boltIndex, error) {
+	// bolt creates missing files even in read only mode
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketOffset) == nil || tx.Bucket(bucketMeta) == nil {
+			return ErrNotVolume
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltIndex{db}, nil
+}
+
+func (bi *boltIndex) View(fn func(tx indexTx) error) error {
+	return bi.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (bi *boltIndex) Update(fn func(tx indexTx) error) error {
+	return bi.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (bi *boltIndex) Sync() error {
+	return bi.db.Sync()
+}
+
+func (bi *boltIndex) Close() error {
+	return bi.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Get(k []byte) []byte {
+	return t.tx.Bucket(bucketOffset).Get(k)
+}
+
+func (t boltTx) Put(k, v []byte) error {
+	return t.tx.Bucket(bucketOffset).Put(k, v)
+}
+
+func (t boltTx) Delete(k []byte) error {
+	return t.tx.Bucket(bucketOffset).Delete(k)
+}
+
+func (t boltTx) ForEach(prefix, after []byte, fn func(k, v []byte) error) error {
+	c := t.tx.Bucket(bucketOffset).Cursor()
+
+	seek := prefix
+	if bytes.Compare(after, prefix) > 0 {
+		seek = after
+	}
+
+	k, v := c.Seek(seek)
+	if after != nil && bytes.Equal(k, after) {
+		k, v = c.Next()
+	}
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t boltTx) GetMeta(k []byte) []byte {
+	return t.tx.Bucket(bucketMeta).Get(k)
+}
+
+func (t boltTx) PutMeta(k, v []byte) error {
+	return t.tx.Bucket(bucketMeta).Put(k, v)
+}
+
+func (t boltTx) DeleteMeta(k []byte) error {
+	return t.tx.Bucket(bucketMeta).Delete(k)
+}
@@ -2,10 +2,15 @@ package sbs
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"testing"
 
 	"github.com/ipfs/go-sbs/consts"
+	pb "github.com/ipfs/go-sbs/pb"
+
+	proto "github.com/gogo/protobuf/proto"
+	ds "github.com/ipfs/go-datastore"
 )
 
 func TestInserting(t *testing.T) {
@@ -67,3 +72,310 @@ func TestInserting(t *testing.T) {
 
 	os.RemoveAll(dir)
 }
+
+func TestDeleteReusesBlocks(t *testing.T) {
+	rng := rng{}
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	k1, v1 := rng.getRandKey(), rng.getRandBlock()
+	if err := sbs.Put(k1, v1); err != nil {
+		t.Fatal(err)
+	}
+	inUse := sbs.curAlloc.InUse()
+
+	if err := sbs.Delete(k1); err != nil {
+		t.Fatal(err)
+	}
+	if sbs.curAlloc.InUse() != 1 {
+		t.Fatalf("expected only allocator block in use, got %d", sbs.curAlloc.InUse())
+	}
+
+	if err := sbs.Put(k1, v1); err != nil {
+		t.Fatal(err)
+	}
+	if sbs.curAlloc.InUse() != inUse {
+		t.Fatalf("freed blocks not reused: %d in use, expected %d",
+			sbs.curAlloc.InUse(), inUse)
+	}
+
+	val, err := sbs.Get(k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(val, v1) {
+		t.Fatal("retrieved data not correct")
+	}
+}
+
+func testOverwrite(t *testing.T, skip bool) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions
+	opts.SkipExisting = skip
+	sbs, err := OpenWithOptions(dir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	k := []byte("/key")
+	v1, v2 := testValue(1, 3*consts.BlockSize), testValue(2, 2*consts.BlockSize)
+	if err := sbs.Put(k, v1); err != nil {
+		t.Fatal(err)
+	}
+	inUse := sbs.curAlloc.InUse()
+
+	expected := v2
+	if skip {
+		expected = v1
+	}
+
+	if err := sbs.Put(k, v2); err != nil {
+		t.Fatal(err)
+	}
+	err = sbs.PutReader(k, bytes.NewReader(v2), int64(len(v2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &Sbsds{sbs: sbs}
+	b, err := fs.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ds.NewKey("/key"), v2); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if skip && sbs.curAlloc.InUse() != inUse {
+		t.Fatalf("value should not be stored again, %d blocks in use, expected %d",
+			sbs.curAlloc.InUse(), inUse)
+	}
+	if !skip && sbs.curAlloc.InUse() != inUse-1 {
+		t.Fatalf("blocks of replaced value were not freed, %d in use, expected %d",
+			sbs.curAlloc.InUse(), inUse-1)
+	}
+
+	val, err := sbs.Get(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(val, expected) {
+		t.Fatal("retrieved data not correct")
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+	testOverwrite(t, false)
+}
+
+func TestSkipExisting(t *testing.T) {
+	testOverwrite(t, true)
+}
+
+func TestInlineValues(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small := testValue(1, DefaultOptions.InlineThreshold-1)
+	large := testValue(2, DefaultOptions.InlineThreshold)
+
+	inUse := sbs.curAlloc.InUse()
+	if err := sbs.Put([]byte("small"), small); err != nil {
+		t.Fatal(err)
+	}
+	if err := sbs.Put([]byte("empty"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if sbs.curAlloc.InUse() != inUse {
+		t.Fatal("inlined values should not allocate blocks")
+	}
+	if err := sbs.Put([]byte("large"), large); err != nil {
+		t.Fatal(err)
+	}
+	if sbs.curAlloc.InUse() != inUse+1 {
+		t.Fatal("value over threshold should take a block")
+	}
+	if err := sbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// with inlining disabled existing direct records still read back
+	sbs, err = OpenWithOptions(dir, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	prec, err := sbs.getPB([]byte("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prec.GetType() != pb.Record_Direct || len(prec.GetBlocks()) != 0 {
+		t.Fatal("small value should be stored in the record")
+	}
+
+	for k, v := range map[string][]byte{"small": small, "empty": {}, "large": large} {
+		out, err := sbs.Get([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, v) {
+			t.Fatalf("value of %s differs", k)
+		}
+	}
+
+	if err := sbs.Put([]byte("small2"), small); err != nil {
+		t.Fatal(err)
+	}
+	prec, err = sbs.getPB([]byte("small2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prec.GetType() != pb.Record_Indirect {
+		t.Fatal("inlining should be disabled")
+	}
+
+	if err := sbs.Delete([]byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := sbs.Has([]byte("small")); has {
+		t.Fatal("deleted value still present")
+	}
+}
+
+func TestExtentRecords(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	v := testValue(1, 512*consts.BlockSize)
+	if err := sbs.Put([]byte("extents"), v); err != nil {
+		t.Fatal(err)
+	}
+	prec, err := sbs.getPB([]byte("extents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prec.GetBlocks()) != 0 || len(prec.GetExtents()) != 1 {
+		t.Fatal("value should be stored as a single extent")
+	}
+
+	// records written before extents list every block
+	inUse := sbs.curAlloc.InUse()
+	exts, err := sbs.allocateN(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := testValue(2, 3*consts.BlockSize-10)
+	sbs.copyToStorage(old, exts)
+
+	blkt := pb.Record_Indirect
+	data, err := proto.Marshal(&pb.Record{
+		Blocks: blocksOf(exts),
+		Size_:  proto.Uint64(uint64(len(old))),
+		Type:   &blkt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sbs.index.Update(func(tx indexTx) error {
+		return tx.Put([]byte("blocks"), data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := sbs.Get([]byte("blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, old) {
+		t.Fatal("value of block list record differs")
+	}
+
+	if err := sbs.Delete([]byte("blocks")); err != nil {
+		t.Fatal(err)
+	}
+	if sbs.curAlloc.InUse() != inUse {
+		t.Fatal("blocks of block list record were not freed")
+	}
+}
+
+func TestTrieRecords(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	// leave one block holes so the value is split into many extents
+	const holes = 600
+	for i := 0; i < 2*holes; i++ {
+		k := []byte(fmt.Sprintf("filler-%d", i))
+		if err := sbs.Put(k, testValue(int64(i), consts.BlockSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2*holes; i += 2 {
+		if err := sbs.Delete([]byte(fmt.Sprintf("filler-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inUse := sbs.curAlloc.InUse()
+	v := testValue(1, holes*consts.BlockSize-100)
+	if err := sbs.Put([]byte("trie"), v); err != nil {
+		t.Fatal(err)
+	}
+
+	prec, err := sbs.getPB([]byte("trie"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prec.GetType() != pb.Record_Trie {
+		t.Fatalf("value should be listed in a trie, got %s", prec.GetType())
+	}
+	if len(prec.GetExtents()) != 0 || len(prec.GetBlocks()) != 0 {
+		t.Fatal("trie record should not list blocks")
+	}
+
+	out, err := sbs.Get([]byte("trie"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, v) {
+		t.Fatal("value read through trie differs")
+	}
+
+	if err := sbs.Delete([]byte("trie")); err != nil {
+		t.Fatal(err)
+	}
+	if sbs.curAlloc.InUse() != inUse {
+		t.Fatalf("blocks of value or trie were not freed, %d in use, expected %d",
+			sbs.curAlloc.InUse(), inUse)
+	}
+}
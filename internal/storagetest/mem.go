@@ -0,0 +1,72 @@
+// Package storagetest provides storage for tests of structures kept in
+// the volume
+package storagetest
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-sbs/consts"
+	"github.com/ipfs/go-sbs/storage"
+)
+
+// Mem keeps blocks in memory, freed blocks are not reused. It is meant for
+// tests, access to a freed block panics.
+type Mem struct {
+	Blks  [][]byte
+	Freed map[uint64]bool
+	// Flushed holds blocks flushed at least once
+	Flushed map[uint64]bool
+}
+
+func NewMem() *Mem {
+	return &Mem{
+		Freed:   make(map[uint64]bool),
+		Flushed: make(map[uint64]bool),
+	}
+}
+
+func (m *Mem) Block(n uint64) []byte {
+	if m.Freed[n] {
+		panic(fmt.Sprintf("access to freed block %d", n))
+	}
+	return m.Blks[n]
+}
+
+func (m *Mem) Allocate(count uint64) (uint64, error) {
+	start := uint64(len(m.Blks))
+	for i := uint64(0); i < count; i++ {
+		m.Blks = append(m.Blks, make([]byte, consts.BlockSize))
+	}
+	return start, nil
+}
+
+func (m *Mem) Free(n uint64, count uint64) error {
+	for i := n; i < n+count; i++ {
+		m.Freed[i] = true
+	}
+	return nil
+}
+
+func (m *Mem) Check(n uint64, count uint64) error {
+	if l := uint64(len(m.Blks)); count == 0 || n >= l || count > l-n {
+		return fmt.Errorf("blocks %d+%d out of range", n, count)
+	}
+	return nil
+}
+
+func (m *Mem) Flush(n uint64, count uint64) error {
+	if err := m.Check(n, count); err != nil {
+		return err
+	}
+	for i := n; i < n+count; i++ {
+		m.Flushed[i] = true
+	}
+	return nil
+}
+
+// InUse returns number of blocks allocated and not freed
+func (m *Mem) InUse() int {
+	return len(m.Blks) - len(m.Freed)
+}
+
+var _ storage.Storage = (*Mem)(nil)
@@ -0,0 +1,139 @@
+package sbs
+
+import (
+	mmap "github.com/gxed/mmap-go"
+)
+
+// Leases protect mapped memory from being unmapped or reused while it is
+// read. Every lease belongs to a generation, retiring a mapping or deferring
+// a free starts a new generation. Retired mappings and deferred blocks are
+// released once no lease of their generation or an older one is held.
+
+type leases struct {
+	gen    uint64
+	active map[uint64]int
+
+	retired  []retiredMap
+	deferred []deferredFree
+}
+
+type retiredMap struct {
+	gen uint64
+	mm  mmap.MMap
+}
+
+type deferredFree struct {
+	gen  uint64
+	exts []extent
+}
+
+// oldest returns generation of the oldest lease held, or the current one if
+// none is held
+func (l *leases) oldest() uint64 {
+	oldest := l.gen
+	for gen := range l.active {
+		if gen < oldest {
+			oldest = gen
+		}
+	}
+	return oldest
+}
+
+// withLease calls fn with a lease held, the lease is released even if fn
+// panics
+func (sbs *Sbs) withLease(fn func() error) (err error) {
+	lease := sbs.acquireLease()
+	defer func() {
+		if rerr := sbs.releaseLease(lease); rerr != nil && err == nil {
+			err = rerr
+		}
+	}()
+	return fn()
+}
+
+// acquireLease makes sure the current mapping of the data file stays mapped
+// and blocks freed from now on are not reused until the lease is released
+func (sbs *Sbs) acquireLease() uint64 {
+	sbs.leaseLk.Lock()
+	defer sbs.leaseLk.Unlock()
+
+	if sbs.leases.active == nil {
+		sbs.leases.active = make(map[uint64]int)
+	}
+	sbs.leases.active[sbs.leases.gen]++
+	return sbs.leases.gen
+}
+
+// releaseLease releases lease acquired by acquireLease, retired mappings and
+// deferred blocks no longer reachable by any lease are released
+func (sbs *Sbs) releaseLease(lease uint64) error {
+	sbs.leaseLk.Lock()
+	l := &sbs.leases
+	if l.active[lease]--; l.active[lease] == 0 {
+		delete(l.active, lease)
+	}
+
+	oldest := l.oldest()
+	var unmap []mmap.MMap
+	var free []extent
+	for len(l.retired) != 0 && l.retired[0].gen < oldest {
+		unmap = append(unmap, l.retired[0].mm)
+		l.retired = l.retired[1:]
+	}
+	for len(l.deferred) != 0 && l.deferred[0].gen < oldest {
+		free = append(free, l.deferred[0].exts...)
+		l.deferred = l.deferred[1:]
+	}
+	sbs.leaseLk.Unlock()
+
+	for _, mm := range unmap {
+		if err := mm.Unmap(); err != nil {
+			return err
+		}
+	}
+	if len(free) == 0 {
+		return nil
+	}
+	return sbs.free(free)
+}
+
+// mapping returns the current mapping of the data file, it can be used only
+// while a lease is held (or with allocLk held)
+func (sbs *Sbs) mapping() mmap.MMap {
+	sbs.leaseLk.Lock()
+	defer sbs.leaseLk.Unlock()
+
+	return sbs.mm
+}
+
+// replaceMap switches to new mapping of the data file, the old one is unmapped
+// immediately if no lease is held
+func (sbs *Sbs) replaceMap(nmm mmap.MMap) error {
+	sbs.leaseLk.Lock()
+	defer sbs.leaseLk.Unlock()
+
+	old := sbs.mm
+	sbs.mm = nmm
+	if len(sbs.leases.active) == 0 {
+		return old.Unmap()
+	}
+
+	sbs.leases.retired = append(sbs.leases.retired, retiredMap{sbs.leases.gen, old})
+	sbs.leases.gen++
+	return nil
+}
+
+// freeLeased frees blocks which may be read under a lease, if any lease is
+// held they are freed once all current leases are released
+func (sbs *Sbs) freeLeased(exts []extent) error {
+	sbs.leaseLk.Lock()
+	if len(sbs.leases.active) != 0 {
+		sbs.leases.deferred = append(sbs.leases.deferred, deferredFree{sbs.leases.gen, exts})
+		sbs.leases.gen++
+		sbs.leaseLk.Unlock()
+		return nil
+	}
+	sbs.leaseLk.Unlock()
+
+	return sbs.free(exts)
+}
@@ -0,0 +1,222 @@
+package sbs
+
+import (
+	"github.com/ipfs/go-sbs/allocator"
+	"github.com/ipfs/go-sbs/consts"
+	pb "github.com/ipfs/go-sbs/pb"
+	"github.com/ipfs/go-sbs/superblock"
+
+	proto "github.com/gogo/protobuf/proto"
+)
+
+// Before the superblock was introduced block 0 of the data file held the first
+// allocator: one byte of version, 24-bit big-endian count of allocated blocks
+// and bitfield starting at byte 64 with bit 0 marking the allocator block
+// itself. The rest of the header was never written.
+const (
+	legacyVersion       = 1
+	legacyInUseStart    = 1
+	legacyInUseEnd      = 4
+	legacyBitfieldStart = 64
+)
+
+// isLegacyVolume reports whether blk (block 0 of the data file of nblks
+// blocks) holds allocator of the legacy layout instead of a superblock
+func isLegacyVolume(blk []byte, nblks uint64) bool {
+	if _, err := superblock.OpenSuperblock(blk); err == nil {
+		return false
+	}
+	if blk[0] != legacyVersion || blk[legacyBitfieldStart]&1 == 0 {
+		return false
+	}
+	for _, b := range blk[legacyInUseEnd:legacyBitfieldStart] {
+		if b != 0 {
+			return false
+		}
+	}
+
+	// blocks were allocated in order and never returned to the counter,
+	// frees only cleared their bits
+	c := blk[legacyInUseStart:legacyInUseEnd]
+	inUse := uint64(c[0])<<16 | uint64(c[1])<<8 | uint64(c[2])
+	if inUse == 0 || inUse > nblks {
+		return false
+	}
+	bitfield := blk[legacyBitfieldStart:]
+	for i := inUse; i < uint64(len(bitfield))*8; i++ {
+		if bitfield[i/8]&(1<<(i%8)) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isLayoutReserved reports whether the block is the superblock or an allocator
+// in the current layout
+func isLayoutReserved(blk uint64) bool {
+	return blk < allocatorStart(0) ||
+		(blk-allocatorStart(0))%allocator.BlocksPerAllocator == 0
+}
+
+// upgradeLegacy rewrites data file of the legacy layout in place.
+//
+// Legacy allocators are not trusted (they never tracked frees correctly), the
+// set of used blocks is rebuilt from the index. Values occupying blocks where
+// the superblock or allocators of the new layout live are moved elsewhere and
+// their records are updated. The superblock is written last so an interrupted
+// upgrade is simply restarted on next Open. Data files without records in the
+// index are not upgraded, ErrNotVolume is returned.
+func (sbs *Sbs) upgradeLegacy() error {
+	var used []bool
+	isUsed := func(blk uint64) bool {
+		return blk < uint64(len(used)) && used[blk]
+	}
+	markUsed := func(blk uint64) {
+		for uint64(len(used)) <= blk {
+			used = append(used, false)
+		}
+		used[blk] = true
+	}
+
+	records := 0
+	err := sbs.index.View(func(tx indexTx) error {
+		return tx.ForEach(nil, nil, func(k, v []byte) error {
+			var prec pb.Record
+			if err := proto.Unmarshal(v, &prec); err != nil {
+				return err
+			}
+			for _, blk := range prec.GetBlocks() {
+				if blk >= uint64(len(sbs.mm))/consts.BlockSize {
+					return ErrNotVolume
+				}
+				markUsed(blk)
+			}
+			records++
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if records == 0 {
+		return ErrNotVolume
+	}
+
+	nalloc := uint64(1)
+	total := func() uint64 {
+		return allocatorEnd(nalloc - 1)
+	}
+	for total() < uint64(len(used)) || total() < uint64(len(sbs.mm))/consts.BlockSize {
+		nalloc++
+	}
+
+	// find new place for values in the way of the new layout
+	moved := make(map[uint64]uint64)
+	free := allocatorStart(0)
+	for blk := uint64(0); blk < uint64(len(used)); blk++ {
+		if !used[blk] || !isLayoutReserved(blk) {
+			continue
+		}
+
+		for isUsed(free) || isLayoutReserved(free) {
+			free++
+		}
+		for free >= total() {
+			nalloc++
+		}
+
+		moved[blk] = free
+		used[blk] = false
+		markUsed(free)
+	}
+
+	if total() > uint64(len(sbs.mm))/consts.BlockSize {
+		if err := sbs.expand(total()); err != nil {
+			return err
+		}
+	}
+
+	if len(moved) != 0 {
+		for from, to := range moved {
+			copy(sbs.mm[to*consts.BlockSize:(to+1)*consts.BlockSize],
+				sbs.mm[from*consts.BlockSize:(from+1)*consts.BlockSize])
+		}
+		if err := sbs.mm.Flush(); err != nil {
+			return err
+		}
+
+		err := sbs.index.Update(func(tx indexTx) error {
+			updates := make(map[string][]byte)
+			err := tx.ForEach(nil, nil, func(k, v []byte) error {
+				var prec pb.Record
+				if err := proto.Unmarshal(v, &prec); err != nil {
+					return err
+				}
+
+				changed := false
+				for i, blk := range prec.Blocks {
+					if to, ok := moved[blk]; ok {
+						prec.Blocks[i] = to
+						changed = true
+					}
+				}
+				if !changed {
+					return nil
+				}
+
+				data, err := proto.Marshal(&prec)
+				if err != nil {
+					return err
+				}
+				updates[string(k)] = data
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for k, data := range updates {
+				if err := tx.Put([]byte(k), data); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// allocators are formatted over the old positions of the moved
+		// blocks, the records must not point there after a crash
+		if err := sbs.index.Sync(); err != nil {
+			return err
+		}
+	}
+
+	sblk := make([]byte, consts.BlockSize)
+	if err := superblock.Format(sblk); err != nil {
+		return err
+	}
+	u := superblock.NewAccessor(sblk).UUID()
+
+	for n := uint64(0); n < nalloc; n++ {
+		blk := sbs.allocatorBlk(n)
+		if err := allocator.FormatAllocator(blk, u); err != nil {
+			return err
+		}
+
+		alloc := allocator.OpenAllocator(blk)
+		for i := uint(1); i < allocator.BlocksPerAllocator; i++ {
+			if isUsed(allocatorStart(n) + uint64(i)) {
+				if err := alloc.Reserve(i, i); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := sbs.mm.Flush(); err != nil {
+		return err
+	}
+
+	copy(sbs.superblockBlk(), sblk)
+	return sbs.mm.Flush()
+}
@@ -0,0 +1,197 @@
+package sbs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-sbs/consts"
+	pb "github.com/ipfs/go-sbs/pb"
+
+	"github.com/boltdb/bolt"
+	proto "github.com/gogo/protobuf/proto"
+)
+
+// writeLegacyVolume creates volume of the legacy layout, values are placed
+// one after another starting at block 1
+func writeLegacyVolume(t *testing.T, dir string, keys, vals [][]byte) {
+	nblks := uint64(1)
+	for _, v := range vals {
+		nblks += blocksNeeded(uint64(len(v)))
+	}
+
+	data := make([]byte, (nblks+3)*consts.BlockSize)
+	data[0] = legacyVersion
+	data[3] = byte(nblks)
+	for i := uint64(0); i < nblks; i++ {
+		data[legacyBitfieldStart+i/8] |= 1 << (i % 8)
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, "index"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	next := uint64(1)
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketOffset)
+		if err != nil {
+			return err
+		}
+
+		for i, v := range vals {
+			var blks []uint64
+			for j := uint64(0); j < blocksNeeded(uint64(len(v))); j++ {
+				blks = append(blks, next)
+				next++
+			}
+			for j, blk := range blks {
+				end := (j + 1) * consts.BlockSize
+				if end > len(v) {
+					end = len(v)
+				}
+				copy(data[blk*consts.BlockSize:], v[j*consts.BlockSize:end])
+			}
+
+			typ := pb.Record_Indirect
+			rec, err := proto.Marshal(&pb.Record{
+				Blocks: blks,
+				Size_:  proto.Uint64(uint64(len(v))),
+				Type:   &typ,
+			})
+			if err != nil {
+				return err
+			}
+			if err := b.Put(keys[i], rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyUpgrade(t *testing.T) {
+	rng := rng{}
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	var keys, vals [][]byte
+	for i := 0; i < 5; i++ {
+		keys = append(keys, rng.getRandKey())
+		vals = append(vals, rng.getRandBlock())
+	}
+	writeLegacyVolume(t, dir, keys, vals)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		for i, k := range keys {
+			val, err := sbs.Get(k)
+			if err != nil {
+				t.Fatalf("key %d: %s", i, err)
+			}
+			if !bytes.Equal(val, vals[i]) {
+				t.Fatalf("value %d differs after upgrade", i)
+			}
+		}
+	}
+	check()
+
+	// new values must not overwrite upgraded ones
+	for i := 0; i < 5; i++ {
+		k := rng.getRandKey()
+		v := rng.getRandBlock()
+		if err := sbs.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+		vals = append(vals, v)
+	}
+	check()
+
+	if err := sbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sbs, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+	check()
+}
+
+func TestLegacyRejectsForeignFiles(t *testing.T) {
+	// checks that Open fails and leaves the data file alone
+	check := func(dir string, data []byte, expected error) {
+		datapath := filepath.Join(dir, "data")
+		if err := ioutil.WriteFile(datapath, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		sbs, err := Open(dir)
+		if err == nil {
+			sbs.Close()
+			t.Fatal("foreign data file should not be opened")
+		}
+		if expected != nil && err != expected {
+			t.Fatalf("expected %v, got: %v", expected, err)
+		}
+		after, err := ioutil.ReadFile(datapath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(after, data) {
+			t.Fatal("data file was modified")
+		}
+	}
+
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	// matches the version and the first bit only
+	data := make([]byte, 4*consts.BlockSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	data[0] = legacyVersion
+	data[legacyBitfieldStart] = 1
+	check(dir, data, nil)
+
+	// valid legacy allocator, but no index
+	data = make([]byte, 4*consts.BlockSize)
+	data[0] = legacyVersion
+	data[3] = 1
+	data[legacyBitfieldStart] = 1
+	check(dir, data, ErrNotVolume)
+
+	// bits set past the end of the file
+	data[3] = 4
+	data[legacyBitfieldStart] = 0x1f
+	check(dir, data, nil)
+
+	// index without records
+	os.Remove(filepath.Join(dir, "data"))
+	writeLegacyVolume(t, dir, nil, nil)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(dir, data, ErrNotVolume)
+}
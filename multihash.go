@@ -0,0 +1,140 @@
+package sbs
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+
+	ds "github.com/ipfs/go-datastore"
+	"golang.org/x/crypto/blake2b"
+)
+
+// ErrHashMismatch is returned when a value doesn't match the multihash
+// encoded in its key
+var ErrHashMismatch = fmt.Errorf("value doesn't match multihash of the key")
+
+// ErrNotContentAddressed is returned when verification is on and the key
+// doesn't encode a multihash of a supported function
+var ErrNotContentAddressed = fmt.Errorf("key doesn't hold a supported multihash")
+
+// VerifyMode selects when values stored through Sbsds are checked against the
+// multihash encoded in their keys
+type VerifyMode int
+
+const (
+	// VerifyPut rejects values that don't match their key when stored
+	VerifyPut VerifyMode = 1 << iota
+	// VerifyGet rejects values that don't match their key when read
+	VerifyGet
+
+	// VerifyNone disables verification
+	VerifyNone VerifyMode = 0
+	// VerifyAlways checks values both when stored and read
+	VerifyAlways = VerifyPut | VerifyGet
+)
+
+// multihash function codes
+const (
+	mhIdentity   = 0x00
+	mhSha1       = 0x11
+	mhSha2_256   = 0x12
+	mhSha2_512   = 0x13
+	mhBlake2bMin = 0xb201
+	mhBlake2bMax = 0xb240
+
+	cidV1 = 1
+)
+
+// keyEncoding is how IPFS encodes binary keys (CIDs or bare multihashes) into
+// the last component of datastore keys
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// keyMultihash decodes function code and digest of the multihash encoded in
+// the last component of k. CIDv1 keys are accepted, other keys are taken as
+// bare multihashes (CIDv0).
+func keyMultihash(k ds.Key) (uint64, []byte, error) {
+	buf, err := keyEncoding.DecodeString(k.BaseNamespace())
+	if err != nil {
+		return 0, nil, ErrNotContentAddressed
+	}
+
+	uvarint := func() (uint64, bool) {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return 0, false
+		}
+		buf = buf[n:]
+		return v, true
+	}
+
+	code, ok := uvarint()
+	if ok && code == cidV1 {
+		// version is followed by content codec and the multihash
+		if _, ok = uvarint(); ok {
+			code, ok = uvarint()
+		}
+	}
+	if !ok {
+		return 0, nil, ErrNotContentAddressed
+	}
+
+	length, ok := uvarint()
+	if !ok || length != uint64(len(buf)) {
+		return 0, nil, ErrNotContentAddressed
+	}
+	return code, buf, nil
+}
+
+// newHash returns hash function of multihash code, nil if it isn't supported
+func newHash(code uint64) hash.Hash {
+	switch {
+	case code == mhSha1:
+		return sha1.New()
+	case code == mhSha2_256:
+		return sha256.New()
+	case code == mhSha2_512:
+		return sha512.New()
+	case code >= mhBlake2bMin && code <= mhBlake2bMax:
+		h, err := blake2b.New(int(code-mhBlake2bMin+1), nil)
+		if err != nil {
+			return nil
+		}
+		return h
+	}
+	return nil
+}
+
+// verifyContent checks val against the multihash encoded in k, digests
+// truncated in the key are compared as prefixes
+func verifyContent(k ds.Key, val []byte) error {
+	code, digest, err := keyMultihash(k)
+	if err != nil {
+		return err
+	}
+
+	var sum []byte
+	if code == mhIdentity {
+		sum = val
+	} else {
+		h := newHash(code)
+		if h == nil {
+			return ErrNotContentAddressed
+		}
+		h.Write(val)
+		sum = h.Sum(nil)
+		if len(digest) > len(sum) {
+			return ErrNotContentAddressed
+		}
+		sum = sum[:len(digest)]
+	}
+
+	if !bytes.Equal(sum, digest) {
+		return ErrHashMismatch
+	}
+	return nil
+}
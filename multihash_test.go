@@ -0,0 +1,113 @@
+package sbs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+	"golang.org/x/crypto/blake2b"
+)
+
+func mhKey(cid bool, code uint64, digest []byte) ds.Key {
+	var buf []byte
+	uvarint := func(v uint64) {
+		b := make([]byte, binary.MaxVarintLen64)
+		buf = append(buf, b[:binary.PutUvarint(b, v)]...)
+	}
+	if cid {
+		uvarint(cidV1)
+		uvarint(0x55) // raw
+	}
+	uvarint(code)
+	uvarint(uint64(len(digest)))
+	buf = append(buf, digest...)
+	return ds.NewKey(keyEncoding.EncodeToString(buf))
+}
+
+func TestVerifyContent(t *testing.T) {
+	val := testValue(1, 1000)
+	sha := sha256.Sum256(val)
+	b2b := blake2b.Sum256(val)
+
+	good := []ds.Key{
+		mhKey(false, mhSha2_256, sha[:]),
+		mhKey(true, mhSha2_256, sha[:]),
+		mhKey(true, 0xb220, b2b[:]),
+		mhKey(false, mhSha2_256, sha[:20]),
+		mhKey(true, mhIdentity, val),
+		ds.NewKey("/blocks").Child(mhKey(false, mhSha2_256, sha[:])),
+	}
+	for _, k := range good {
+		if err := verifyContent(k, val); err != nil {
+			t.Fatalf("%s: %s", k, err)
+		}
+	}
+
+	if err := verifyContent(mhKey(true, 0xb220, sha[:]), val); err != ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch, got: %v", err)
+	}
+	bad := []ds.Key{
+		ds.NewKey("/not-a-hash"),
+		mhKey(false, 0x99, sha[:]),
+		mhKey(false, mhSha2_256, append(sha[:], 0)),
+	}
+	for _, k := range bad {
+		if err := verifyContent(k, val); err != ErrNotContentAddressed {
+			t.Fatalf("%s: expected ErrNotContentAddressed, got: %v", k, err)
+		}
+	}
+}
+
+func TestDatastoreVerify(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions
+	opts.Verify = VerifyAlways
+	fs, err := NewSbsDSWithOptions(dir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	val := testValue(1, 1000)
+	sha := sha256.Sum256(val)
+	k := mhKey(false, mhSha2_256, sha[:])
+	other := mhKey(false, mhSha2_256, make([]byte, len(sha)))
+
+	if err := fs.Put(k, val); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Put(other, val); err != ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch, got: %v", err)
+	}
+	b, err := fs.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(other, val); err != ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch, got: %v", err)
+	}
+
+	if _, err := fs.Get(k); err != nil {
+		t.Fatal(err)
+	}
+
+	// stored without verification
+	if err := fs.sbs.Put(other.Bytes(), val); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Get(other); err != ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch, got: %v", err)
+	}
+	res, err := fs.Query(query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := res.Rest(); err != ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch from query, got: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package sbs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-sbs/consts"
+	"github.com/ipfs/go-sbs/superblock"
+
+	"github.com/juju/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestOpenFormatsSuperblock(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := sbs.sb.UUID()
+	if uuid.Equal(u, uuid.Nil) {
+		t.Fatal("new volume should have UUID")
+	}
+	if err := sbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sbs, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	if !uuid.Equal(u, sbs.sb.UUID()) {
+		t.Fatal("UUID changed after reopen")
+	}
+}
+
+func TestOpenRejectsForeignFile(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	junk := make([]byte, allocatorEnd(0)*consts.BlockSize)
+	for i := range junk {
+		junk[i] = byte(i)
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, "data"), junk, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(dir)
+	if errors.Cause(err) != superblock.ErrMagicMissMatch {
+		t.Fatalf("expected magic missmatch, got: %v", err)
+	}
+}
+
+func TestOpenRejectsSmallFile(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	err := ioutil.WriteFile(filepath.Join(dir, "data"), []byte("sbs"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(dir)
+	if err != ErrVolumeTooSmall {
+		t.Fatalf("expected ErrVolumeTooSmall, got: %v", err)
+	}
+}
+
+func TestOpenResumesAllocator(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbs.allocLk.Lock()
+	err = sbs.nextAllocator()
+	sbs.allocLk.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sbs, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sbs.curAlloc.n != 1 || sbs.sb.AllocatorCount() != 2 {
+		t.Fatalf("expected to resume at allocator 1 of 2, got %d of %d",
+			sbs.curAlloc.n, sbs.sb.AllocatorCount())
+	}
+	if err := sbs.Put([]byte("key"), testValue(1, consts.BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	prec, err := sbs.getPB([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := allocatorOf(recordExtents(prec)[0].start); n != 1 {
+		t.Fatalf("value should be stored in allocator 1, got %d", n)
+	}
+
+	// fill the current allocator
+	if err := sbs.curAlloc.Reserve(1, maxAllocation); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sbs.curAlloc.Allocate(1); err == nil {
+		t.Fatal("allocator should be full")
+	}
+	if err := sbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sbs, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+	if sbs.curAlloc.n != 0 {
+		t.Fatalf("expected to continue in allocator 0, got %d", sbs.curAlloc.n)
+	}
+}
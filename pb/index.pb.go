@@ -10,6 +10,7 @@ It is generated from these files:
 
 It has these top-level messages:
 	Record
+	Extent
 */
 package index
 
@@ -27,15 +28,18 @@ type Record_Type int32
 const (
 	Record_Direct   Record_Type = 1
 	Record_Indirect Record_Type = 2
+	Record_Trie     Record_Type = 3
 )
 
 var Record_Type_name = map[int32]string{
 	1: "Direct",
 	2: "Indirect",
+	3: "Trie",
 }
 var Record_Type_value = map[string]int32{
 	"Direct":   1,
 	"Indirect": 2,
+	"Trie":     3,
 }
 
 func (x Record_Type) Enum() *Record_Type {
@@ -60,6 +64,9 @@ type Record struct {
 	Blocks           []uint64     `protobuf:"varint,2,rep,name=blocks" json:"blocks,omitempty"`
 	Size_            *uint64      `protobuf:"varint,3,opt,name=size" json:"size,omitempty"`
 	Data             []byte       `protobuf:"bytes,4,opt,name=data" json:"data,omitempty"`
+	Extents          []*Extent    `protobuf:"bytes,5,rep,name=extents" json:"extents,omitempty"`
+	Trie             *uint64      `protobuf:"varint,6,opt,name=trie" json:"trie,omitempty"`
+	Crc32C           *uint32      `protobuf:"fixed32,7,opt,name=crc32c" json:"crc32c,omitempty"`
 	XXX_unrecognized []byte       `json:"-"`
 }
 
@@ -95,7 +102,53 @@ func (m *Record) GetData() []byte {
 	return nil
 }
 
+func (m *Record) GetExtents() []*Extent {
+	if m != nil {
+		return m.Extents
+	}
+	return nil
+}
+
+func (m *Record) GetTrie() uint64 {
+	if m != nil && m.Trie != nil {
+		return *m.Trie
+	}
+	return 0
+}
+
+func (m *Record) GetCrc32C() uint32 {
+	if m != nil && m.Crc32C != nil {
+		return *m.Crc32C
+	}
+	return 0
+}
+
+type Extent struct {
+	Start            *uint64 `protobuf:"varint,1,opt,name=start" json:"start,omitempty"`
+	Length           *uint64 `protobuf:"varint,2,opt,name=length" json:"length,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Extent) Reset()         { *m = Extent{} }
+func (m *Extent) String() string { return proto.CompactTextString(m) }
+func (*Extent) ProtoMessage()    {}
+
+func (m *Extent) GetStart() uint64 {
+	if m != nil && m.Start != nil {
+		return *m.Start
+	}
+	return 0
+}
+
+func (m *Extent) GetLength() uint64 {
+	if m != nil && m.Length != nil {
+		return *m.Length
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Record)(nil), "Record")
+	proto.RegisterType((*Extent)(nil), "Extent")
 	proto.RegisterEnum("Record_Type", Record_Type_name, Record_Type_value)
 }
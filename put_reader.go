@@ -0,0 +1,155 @@
+package sbs
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/ipfs/go-sbs/consts"
+)
+
+// ErrShortValue is returned by PutReader when reader ends before size bytes
+// were read
+var ErrShortValue = fmt.Errorf("reader ended before the end of the value")
+
+const (
+	// streamChunk is number of blocks allocated at once when size of the
+	// value is not known
+	streamChunk = 128
+)
+
+// PutReader stores value of size bytes read from r under k. Blocks are
+// allocated upfront and the data is read directly into them, the record is
+// published after the last byte was read. If reading fails the blocks are
+// freed and nothing is stored. Data after size bytes is not read.
+func (sbs *Sbs) PutReader(k []byte, r io.Reader, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("negative value size: %d", size)
+	}
+	return sbs.putReader(k, io.LimitReader(r, size), size)
+}
+
+// PutReaderUnknownSize stores value read from r until io.EOF under k. Blocks
+// are allocated in chunks as data arrives, otherwise it behaves like
+// PutReader.
+func (sbs *Sbs) PutReaderUnknownSize(k []byte, r io.Reader) error {
+	return sbs.putReader(k, r, -1)
+}
+
+func (sbs *Sbs) putReader(k []byte, r io.Reader, size int64) error {
+	if skip, err := sbs.skipPut(k); skip || err != nil {
+		return err
+	}
+
+	data, err := sbs.storeReader(r, size)
+	if err != nil {
+		return err
+	}
+	return sbs.commitPut(k, data)
+}
+
+// storeReader writes value read from r to the volume and returns serialized
+// record of it, size is -1 if it is not known
+func (sbs *Sbs) storeReader(r io.Reader, size int64) ([]byte, error) {
+	// values that would be inlined are never written to blocks
+	head := make([]byte, sbs.opts.InlineThreshold)
+	n, err := io.ReadFull(r, head)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		if size >= 0 && int64(n) != size {
+			return nil, ErrShortValue
+		}
+		return createDirectRecord(head[:n])
+	case nil:
+	default:
+		return nil, err
+	}
+
+	var exts []extent
+	var total uint64
+	var crc uint32
+	fail := func(err error, unused []extent) ([]byte, error) {
+		if ferr := sbs.free(append(exts, unused...)); ferr != nil {
+			return nil, ferr
+		}
+		return nil, err
+	}
+
+	for eof := false; !eof; {
+		want := uint64(streamChunk)
+		if size >= 0 {
+			want = blocksNeeded(uint64(size)) - extentsLength(exts)
+			if want == 0 {
+				break
+			}
+		}
+
+		nexts, err := sbs.allocateN(want)
+		if err != nil {
+			return fail(err, nil)
+		}
+
+		for i, e := range nexts {
+			if eof {
+				// the value ended in one of the previous extents
+				if err := sbs.free(nexts[i:]); err != nil {
+					return fail(err, nil)
+				}
+				break
+			}
+
+			var c, n int
+			err := sbs.withLease(func() error {
+				off := e.start * consts.BlockSize
+				buf := sbs.mapping()[off : off+e.length*consts.BlockSize]
+				c = copy(buf, head)
+				head = head[c:]
+
+				var err error
+				n, err = io.ReadFull(r, buf[c:])
+				crc = crc32.Update(crc, castagnoli, buf[:c+n])
+				return err
+			})
+			switch err {
+			case io.EOF, io.ErrUnexpectedEOF:
+				eof = true
+			case nil:
+			default:
+				return fail(err, nexts[i:])
+			}
+			written := uint64(c + n)
+			total += written
+
+			used := extent{e.start, blocksNeeded(written)}
+			if used.length < e.length {
+				if err := sbs.free([]extent{{used.last() + 1, e.length - used.length}}); err != nil {
+					return fail(err, append([]extent{used}, nexts[i+1:]...))
+				}
+			}
+			if used.length == 0 {
+				continue
+			}
+
+			if l := len(exts) - 1; l >= 0 && exts[l].last()+1 == used.start {
+				exts[l].length += used.length
+			} else {
+				exts = append(exts, used)
+			}
+		}
+	}
+
+	if size >= 0 && total != uint64(size) {
+		return fail(ErrShortValue, nil)
+	}
+	if err := sbs.syncExtents(exts); err != nil {
+		return fail(err, nil)
+	}
+
+	var data []byte
+	err = sbs.withLease(func() error {
+		var err error
+		data, err = sbs.createBlocksRecord(total, crc, exts)
+		return err
+	})
+	return data, err
+}
@@ -0,0 +1,102 @@
+package sbs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-sbs/consts"
+)
+
+// errReader returns data and then fails
+type errReader struct {
+	data []byte
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, fmt.Errorf("read failed")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestPutReader(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	sizes := []int{0, 10, DefaultOptions.InlineThreshold, consts.BlockSize,
+		3*consts.BlockSize + 5, (streamChunk+3)*consts.BlockSize - 1}
+	for i, size := range sizes {
+		v := testValue(int64(i), size)
+
+		k := []byte(fmt.Sprintf("sized-%d", size))
+		// trailing data is not part of the value
+		r := io.MultiReader(bytes.NewReader(v), bytes.NewReader([]byte("trailer")))
+		if err := sbs.PutReader(k, r, int64(size)); err != nil {
+			t.Fatal(err)
+		}
+
+		uk := []byte(fmt.Sprintf("unsized-%d", size))
+		if err := sbs.PutReaderUnknownSize(uk, bytes.NewReader(v)); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, k := range [][]byte{k, uk} {
+			out, err := sbs.Get(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, v) {
+				t.Fatalf("value of %s differs", k)
+			}
+		}
+	}
+}
+
+func TestPutReaderFailure(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	v := testValue(1, 10*consts.BlockSize)
+	inUse := sbs.curAlloc.InUse()
+
+	err = sbs.PutReader([]byte("short"), bytes.NewReader(v), int64(len(v)+1))
+	if err != ErrShortValue {
+		t.Fatalf("expected ErrShortValue, got: %v", err)
+	}
+
+	err = sbs.PutReader([]byte("failed"), &errReader{v}, int64(2*len(v)))
+	if err == nil {
+		t.Fatal("expected error from the reader")
+	}
+
+	err = sbs.PutReaderUnknownSize([]byte("failed"), &errReader{v})
+	if err == nil {
+		t.Fatal("expected error from the reader")
+	}
+
+	if sbs.curAlloc.InUse() != inUse {
+		t.Fatal("blocks of failed values were not freed")
+	}
+	for _, k := range []string{"short", "failed"} {
+		if has, _ := sbs.Has([]byte(k)); has {
+			t.Fatalf("failed value %s was stored", k)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package sbs
+
+import (
+	"bytes"
+
+	"github.com/ipfs/go-sbs/allocator"
+	"github.com/ipfs/go-sbs/consts"
+	"github.com/ipfs/go-sbs/hamt"
+	pb "github.com/ipfs/go-sbs/pb"
+	"github.com/ipfs/go-sbs/superblock"
+	"github.com/ipfs/go-sbs/trie"
+
+	proto "github.com/gogo/protobuf/proto"
+)
+
+// RecoveryStats describes changes made by the recovery pass run when a volume
+// that was not closed cleanly is opened
+type RecoveryStats struct {
+	// Leaked is number of blocks marked as used that nothing referenced,
+	// they were freed
+	Leaked uint64
+	// Lost is number of referenced blocks that were marked as free, they
+	// were marked as used again
+	Lost uint64
+	// BadRecords are keys of records that can't be read or point outside
+	// of the volume, their valid blocks stay in use. Fsck tells more.
+	BadRecords [][]byte
+}
+
+// Recovery returns what the recovery pass changed, nil if the volume was
+// closed cleanly and no recovery was needed
+func (sbs *Sbs) Recovery() *RecoveryStats {
+	return sbs.recovery
+}
+
+// blockSet is a set of blocks of the volume, bitfields are kept per allocator
+type blockSet map[uint64][]byte
+
+// add adds blocks of e to the set and returns how many of them were already
+// in it
+func (s blockSet) add(e extent) uint64 {
+	var dup uint64
+	for blk := e.start; blk <= e.last(); blk++ {
+		n, i := allocatorOf(blk)
+		bits, ok := s[n]
+		if !ok {
+			bits = make([]byte, allocator.BlocksPerAllocator/8)
+			s[n] = bits
+		}
+		if bits[i/8]&(1<<(i%8)) != 0 {
+			dup++
+		}
+		bits[i/8] |= 1 << (i % 8)
+	}
+	return dup
+}
+
+func (s blockSet) has(n uint64, i uint) bool {
+	bits, ok := s[n]
+	return ok && bits[i/8]&(1<<(i%8)) != 0
+}
+
+// allocators returns number of allocators covered by the data file
+func (sbs *Sbs) allocators() uint64 {
+	nblks := uint64(len(sbs.mapping())) / consts.BlockSize
+	return (nblks - allocatorStart(0)) / allocator.BlocksPerAllocator
+}
+
+// checkExtent verifies that e lies within the volume and doesn't overlap
+// an allocator block, extents read from the volume have to be checked before
+// the mapping is accessed
+func (sbs *Sbs) checkExtent(e extent) error {
+	end := allocatorStart(sbs.allocators())
+	if e.length == 0 || e.start < allocatorStart(0) || e.start >= end ||
+		e.length > end-e.start {
+		return &extentError{e, "outside of the volume"}
+	}
+	first, i := allocatorOf(e.start)
+	last, _ := allocatorOf(e.last())
+	if i == 0 || first != last {
+		return &extentError{e, "overlaps allocator block"}
+	}
+	return nil
+}
+
+// walkReferences calls fn for every extent referenced from the index: nodes
+// of the in-volume index (with nil key), blocks of values and blocks of their
+// tries. Extents are not checked, fn has to check them before the blocks are
+// accessed. Records that can't be read are passed to bad, iteration stops at
+// first error returned by either. Returns number of records.
+func (sbs *Sbs) walkReferences(fn func(k []byte, e extent) error, bad func(k []byte, err error) error) (uint64, error) {
+	var records uint64
+	err := sbs.withLease(func() error {
+		return sbs.index.View(func(tx indexTx) error {
+			// nodes are walked in the view, they can't be changed by
+			// concurrent updates meanwhile
+			if hi, ok := sbs.index.(*hamtIndex); ok {
+				err := hi.h.ForEachNode(func(blk uint64) error {
+					return fn(nil, extent{blk, hamt.NodeBlocks})
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			return tx.ForEach(nil, nil, func(k, v []byte) error {
+				records++
+
+				var prec pb.Record
+				if err := proto.Unmarshal(v, &prec); err != nil {
+					return bad(k, err)
+				}
+
+				// extents are passed on unchecked so valid ones are
+				// visited also after a broken one
+				var ferr error
+				add := func(e extent) error {
+					ferr = fn(k, e)
+					return ferr
+				}
+				var err error
+				if prec.GetType() == pb.Record_Trie {
+					err = trie.ForEach(volumeStorage{sbs}, prec.GetTrie(), 0, func(e trie.Extent) error {
+						return add(extent{e.Start, e.Length})
+					})
+					if err == nil {
+						err = trie.Blocks(volumeStorage{sbs}, prec.GetTrie(), func(blk uint64) error {
+							return add(extent{blk, 1})
+						})
+					}
+				} else {
+					for _, e := range recordExtents(&prec) {
+						if err = add(e); err != nil {
+							break
+						}
+					}
+				}
+				if err != nil && err != ferr {
+					return bad(k, err)
+				}
+				return err
+			})
+		})
+	})
+	return records, err
+}
+
+// referencedBlocks collects blocks referenced from the index. Keys of records
+// that can't be read or point outside of the volume are returned, extents of
+// them that are valid are collected too.
+func (sbs *Sbs) referencedBlocks() (blockSet, [][]byte, error) {
+	refs := make(blockSet)
+	var bad [][]byte
+	addBad := func(k []byte) {
+		if l := len(bad); l == 0 || !bytes.Equal(bad[l-1], k) {
+			bad = append(bad, append([]byte(nil), k...))
+		}
+	}
+
+	_, err := sbs.walkReferences(func(k []byte, e extent) error {
+		if err := sbs.checkExtent(e); err != nil {
+			addBad(k)
+			return nil
+		}
+		refs.add(e)
+		return nil
+	}, func(k []byte, err error) error {
+		addBad(k)
+		return nil
+	})
+	return refs, bad, err
+}
+
+// recoverAllocators rebuilds bitfields of allocators from blocks referenced
+// by the index. It must be run before the volume is used.
+func (sbs *Sbs) recoverAllocators() (*RecoveryStats, error) {
+	refs, bad, err := sbs.referencedBlocks()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := sbs.rebuildAllocators(refs)
+	if err != nil {
+		return nil, err
+	}
+	stats.BadRecords = bad
+	return stats, nil
+}
+
+// rebuildAllocators makes bitfields of allocators match refs
+func (sbs *Sbs) rebuildAllocators(refs blockSet) (*RecoveryStats, error) {
+	sbs.allocLk.Lock()
+	defer sbs.allocLk.Unlock()
+
+	stats := &RecoveryStats{}
+	for n := uint64(0); n < sbs.allocators(); n++ {
+		alloc, err := sbs.allocatorFor(n)
+		if err != nil {
+			return nil, err
+		}
+
+		var leaked, lost uint64
+		for i := uint(1); i < allocator.BlocksPerAllocator; i++ {
+			used, ref := alloc.IsUsed(i), refs.has(n, i)
+			switch {
+			case used && !ref:
+				leaked++
+			case ref && !used:
+				lost++
+			}
+		}
+		if leaked == 0 && lost == 0 && alloc.Check() == nil {
+			continue
+		}
+		stats.Leaked += leaked
+		stats.Lost += lost
+
+		alloc.Reset()
+		for i := uint(1); i < allocator.BlocksPerAllocator; i++ {
+			if !refs.has(n, i) {
+				continue
+			}
+			end := i
+			for end+1 < allocator.BlocksPerAllocator && refs.has(n, end+1) {
+				end++
+			}
+			if err := alloc.Reserve(i, end); err != nil {
+				return nil, err
+			}
+			i = end
+		}
+		sbs.markDirty(n)
+	}
+	return stats, nil
+}
+
+// markOpen clears the clean shutdown flag, the change is flushed before
+// anything else is written
+func (sbs *Sbs) markOpen() error {
+	w := superblock.NewWriter(sbs.superblockBlk())
+	w.SetFlags(sbs.sb.Flags() &^ superblock.FlagClean)
+	return flushRange(sbs.mm, 0, consts.BlockSize)
+}
+
+// markClean sets the clean shutdown flag, everything has to be synced first
+func (sbs *Sbs) markClean() error {
+	w := superblock.NewWriter(sbs.superblockBlk())
+	w.SetFlags(sbs.sb.Flags() | superblock.FlagClean)
+	return flushRange(sbs.mm, 0, consts.BlockSize)
+}
@@ -0,0 +1,164 @@
+package sbs
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-sbs/consts"
+
+	proto "github.com/gogo/protobuf/proto"
+)
+
+func testRecovery(t *testing.T, opts *Options) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		k := fmt.Sprintf("key-%d", i)
+		vals[k] = testValue(int64(i), i*consts.BlockSize+1)
+		if err := sbs.Put([]byte(k), vals[k]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sbs, err = OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sbs.Recovery() != nil {
+		t.Fatal("cleanly closed volume should not be recovered")
+	}
+	inUse := sbs.curAlloc.InUse()
+
+	// crash after blocks were allocated but before the record was stored
+	if _, err := sbs.allocateN(7); err != nil {
+		t.Fatal(err)
+	}
+	// crash after the record was deleted but before blocks were freed
+	prec, err := sbs.getPB([]byte("key-3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sbs.index.Update(func(tx indexTx) error {
+		return tx.Delete([]byte("key-3"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(vals, "key-3")
+	// blocks of a stored value freed without removing the record
+	prec5, err := sbs.getPB([]byte("key-5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sbs.free(recordExtents(prec5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sbs.close(false); err != nil {
+		t.Fatal(err)
+	}
+
+	sbs, err = OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	stats := sbs.Recovery()
+	if stats == nil {
+		t.Fatal("volume should have been recovered")
+	}
+	leaked := 7 + extentsLength(recordExtents(prec))
+	if stats.Leaked != leaked {
+		t.Fatalf("expected %d leaked blocks, got %d", leaked, stats.Leaked)
+	}
+	if lost := extentsLength(recordExtents(prec5)); stats.Lost != lost {
+		t.Fatalf("expected %d lost blocks, got %d", lost, stats.Lost)
+	}
+	// only blocks of the deleted value are gone
+	if expected := inUse - uint(extentsLength(recordExtents(prec))); sbs.curAlloc.InUse() != expected {
+		t.Fatalf("%d blocks in use after recovery, expected %d", sbs.curAlloc.InUse(), expected)
+	}
+	checkValues(t, sbs, vals)
+}
+
+func TestRecovery(t *testing.T) {
+	testRecovery(t, nil)
+}
+
+func TestRecoveryHamt(t *testing.T) {
+	testRecovery(t, &Options{Index: IndexHamt, InlineThreshold: 256})
+}
+
+func TestRecoveryBadRecords(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"bad", "good"} {
+		if err := sbs.Put([]byte(k), testValue(1, 3*consts.BlockSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prec, err := sbs.getPB([]byte("bad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := extent{recordExtents(prec)[0].start, 1}
+	prec.Extents = pbExtents([]extent{valid, {1 << 62, 2}})
+	data, err := proto.Marshal(prec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sbs.index.Update(func(tx indexTx) error {
+		if err := tx.Put([]byte("bad"), data); err != nil {
+			return err
+		}
+		return tx.Put([]byte("junk"), []byte{0xff, 0xff})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sbs.close(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// bad records don't keep the volume from opening
+	sbs, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	stats := sbs.Recovery()
+	if stats == nil {
+		t.Fatal("volume should have been recovered")
+	}
+	if len(stats.BadRecords) != 2 || string(stats.BadRecords[0]) != "bad" || string(stats.BadRecords[1]) != "junk" {
+		t.Fatalf("unexpected bad records: %q", stats.BadRecords)
+	}
+	n, i := allocatorOf(valid.start)
+	alloc, err := sbs.allocatorFor(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !alloc.IsUsed(i) {
+		t.Fatal("valid blocks of bad record should stay in use")
+	}
+	if _, err := sbs.Get([]byte("good")); err != nil {
+		t.Fatal(err)
+	}
+}
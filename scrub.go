@@ -0,0 +1,100 @@
+package sbs
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/ipfs/go-sbs/pb"
+
+	proto "github.com/gogo/protobuf/proto"
+)
+
+var (
+	keyScrubCursor = []byte("scrub-cursor")
+)
+
+// Scrub reads values in the index order and verifies them against their
+// checksums, reading at most rate bytes per second (0 means no limit). Values
+// that fail verification are passed to fn together with the error, scrubbing
+// continues with the next one.
+//
+// The position is remembered in the index every few seconds and when Scrub
+// returns, so the next call (also after reopening the volume) continues where
+// this one stopped. Scrub returns once a pass over the index is done or ctx
+// is done, with the number of values verified. It is meant to be run in
+// a separate goroutine while the volume is in use.
+func (sbs *Sbs) Scrub(ctx context.Context, rate uint64, fn func(k []byte, err error)) (uint64, error) {
+	cursor, err := sbs.cursor(keyScrubCursor)
+	if err != nil {
+		return 0, err
+	}
+
+	var scrubbed, read uint64
+	start := time.Now()
+	saved := start
+	for {
+		if err := ctx.Err(); err != nil {
+			return scrubbed, sbs.setCursor(keyScrubCursor, cursor)
+		}
+
+		k, size, verr, err := sbs.scrubNext(cursor)
+		if err != nil {
+			return scrubbed, err
+		}
+		if k == nil {
+			// pass over the index is done, start from the beginning next time
+			return scrubbed, sbs.setCursor(keyScrubCursor, nil)
+		}
+		cursor = k
+		scrubbed++
+		if verr != nil {
+			fn(k, verr)
+		}
+
+		if time.Since(saved) >= cursorCheckpoint {
+			if err := sbs.setCursor(keyScrubCursor, cursor); err != nil {
+				return scrubbed, err
+			}
+			saved = time.Now()
+		}
+
+		if rate == 0 {
+			continue
+		}
+		read += size
+		want := time.Duration(float64(read) / float64(rate) * float64(time.Second))
+		if d := want - time.Since(start); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+			}
+		}
+	}
+}
+
+// scrubNext reads and verifies value of the first record after key after.
+// Returns its key (nil at the end of the index), size and the error reading
+// of the value failed with, err is set if the index can't be read.
+func (sbs *Sbs) scrubNext(after []byte) (k []byte, size uint64, verr, err error) {
+	// the lease is taken before the record is read, its blocks can't be
+	// reused even if the value is deleted meanwhile
+	err = sbs.withLease(func() error {
+		var v []byte
+		var err error
+		k, v, err = sbs.nextRecord(after)
+		if err != nil || k == nil {
+			return err
+		}
+
+		var prec pb.Record
+		if verr = proto.Unmarshal(v, &prec); verr != nil {
+			return nil
+		}
+		size = prec.GetSize_()
+		verr = sbs.read(k, &prec, make([]byte, size))
+		return nil
+	})
+	return k, size, verr, err
+}
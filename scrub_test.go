@@ -0,0 +1,90 @@
+package sbs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-sbs/consts"
+
+	"github.com/juju/errors"
+)
+
+func TestScrub(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		k := []byte(fmt.Sprintf("key-%d", i))
+		if err := sbs.Put(k, testValue(int64(i), i*consts.BlockSize/2+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prec, err := sbs.getPB([]byte("key-7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbs.mm[recordExtents(prec)[0].start*consts.BlockSize] ^= 1
+
+	// stop right after the corrupted value is found
+	ctx, cancel := context.WithCancel(context.Background())
+	var corrupt []string
+	first, err := sbs.Scrub(ctx, 0, func(k []byte, err error) {
+		if errors.Cause(err) != ErrCorrupted {
+			t.Fatalf("expected ErrCorrupted, got: %v", err)
+		}
+		corrupt = append(corrupt, string(k))
+		cancel()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupt) != 1 || corrupt[0] != "key-7" {
+		t.Fatalf("expected key-7 to be corrupted, got: %v", corrupt)
+	}
+	if err := sbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// position is kept across reopen
+	sbs, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	rest, err := sbs.Scrub(context.Background(), 0, func(k []byte, err error) {
+		t.Fatalf("%s should not be scrubbed again", k)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first+rest != n {
+		t.Fatalf("%d values scrubbed, expected %d", first+rest, n)
+	}
+
+	// the pass was finished, next one starts over and is throttled
+	var size uint64
+	for i := 0; i < n; i++ {
+		size += uint64(i*consts.BlockSize/2 + 1)
+	}
+	start := time.Now()
+	all, err := sbs.Scrub(context.Background(), size*4, func([]byte, error) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all != n {
+		t.Fatalf("%d values scrubbed, expected %d", all, n)
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatal("scrubbing was not throttled")
+	}
+}
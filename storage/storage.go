@@ -0,0 +1,18 @@
+package storage
+
+// Storage provides blocks for structures kept in the volume, such as HAMT
+// nodes and block tries
+type Storage interface {
+	// Block returns content of n-th block, it is valid until next Allocate
+	Block(n uint64) []byte
+	// Allocate allocates count consecutive blocks and returns the first one
+	Allocate(count uint64) (uint64, error)
+	// Free releases count consecutive blocks starting with n
+	Free(n uint64, count uint64) error
+	// Check returns an error if count blocks starting with n are not valid
+	// blocks of the storage, block numbers read from the storage have to
+	// be checked before they are passed to Block
+	Check(n uint64, count uint64) error
+	// Flush makes content of count blocks starting with n durable
+	Flush(n uint64, count uint64) error
+}
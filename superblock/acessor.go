@@ -21,35 +21,35 @@ func NewAccessor(blk []byte) *Accessor {
 
 func (a *Accessor) checks() error {
 	if !bytes.Equal(a.MagicBytes(), []byte(magicBytes)) {
-		return errMagicMissMatch
+		return ErrMagicMissMatch
 	}
 	if a.Version() != 1 {
-		return errWrongVersion
+		return ErrWrongVersion
 	}
 	if a.Flags()&reservedMask != 0 {
-		return errFlagsReserved
+		return ErrFlagsReserved
 	}
 
 	u := a.UUID()
 	if uuid.Equal(u, uuid.Nil) {
-		return errUUIDNil
+		return ErrUUIDNil
 	}
 
 	u2 := a.SecondaryUUID()
 	if !uuid.Equal(u, u2) {
-		return errUUIDCopyMissMatch
+		return ErrUUIDCopyMissMatch
 	}
 
 	if a.BlockSize() != consts.BlockSize {
-		return errBlockSizeDifferent
+		return ErrBlockSizeDifferent
 	}
 
 	if !isJustZero(a.blk[zero1Start:zero1End]) {
-		return errZeroPartIsNotZeroed
+		return ErrZeroPartIsNotZeroed
 	}
 
 	if !isJustZero(a.blk[zero2Start:zero2End]) {
-		return errZeroPartIsNotZeroed
+		return ErrZeroPartIsNotZeroed
 	}
 
 	return nil
@@ -96,3 +96,20 @@ func (a *Accessor) BlockSize() uint32 {
 func (a *Accessor) Flags() uint16 {
 	return binary.Uint16(a.blk[flagsStart:flagsEnd])
 }
+
+// IndexRoot returns block index of the root of in-volume index
+func (a *Accessor) IndexRoot() uint64 {
+	return binary.Uint64(a.blk[idxRootStart:idxRootEnd])
+}
+
+// AllocatorCount returns number of allocators formatted in the volume, 0 if
+// it wasn't recorded
+func (a *Accessor) AllocatorCount() uint64 {
+	return binary.Uint64(a.blk[allocCntStart:allocCntEnd])
+}
+
+// CurrentAllocator returns number of the allocator new blocks were last
+// allocated from
+func (a *Accessor) CurrentAllocator() uint64 {
+	return binary.Uint64(a.blk[curAllocStart:curAllocEnd])
+}
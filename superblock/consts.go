@@ -15,7 +15,13 @@ const (
 	flagsEnd      = flagsStart + 2
 	blkSizeStart  = flagsEnd
 	blkSizeEnd    = blkSizeStart + 4
-	zero1Start    = blkSizeEnd
+	idxRootStart  = blkSizeEnd
+	idxRootEnd    = idxRootStart + 8
+	allocCntStart = idxRootEnd
+	allocCntEnd   = allocCntStart + 8
+	curAllocStart = allocCntEnd
+	curAllocEnd   = curAllocStart + 8
+	zero1Start    = curAllocEnd
 	zero1End      = consts.BlockSize / 2
 	uuidCopyStart = zero1End
 	uuidCopyEnd   = uuidCopyStart + 16
@@ -4,12 +4,15 @@ import (
 	errors "github.com/juju/errors"
 )
 
+// Errors returned by OpenSuperblock when the block does not hold a valid
+// sbs superblock. They are wrapped with errors.Trace, use errors.Cause to
+// compare against them.
 var (
-	errMagicMissMatch      = errors.New("magic bytes different than expected")
-	errUUIDCopyMissMatch   = errors.New("copies of UUID and different")
-	errZeroPartIsNotZeroed = errors.New("area that should be zero is not")
-	errWrongVersion        = errors.New("version is not 1")
-	errFlagsReserved       = errors.New("reserved flag is set")
-	errBlockSizeDifferent  = errors.New("blockszie different than implemntation")
-	errUUIDNil             = errors.New("UUID is Nil")
+	ErrMagicMissMatch      = errors.New("magic bytes different than expected")
+	ErrUUIDCopyMissMatch   = errors.New("copies of UUID and different")
+	ErrZeroPartIsNotZeroed = errors.New("area that should be zero is not")
+	ErrWrongVersion        = errors.New("version is not 1")
+	ErrFlagsReserved       = errors.New("reserved flag is set")
+	ErrBlockSizeDifferent  = errors.New("blockszie different than implemntation")
+	ErrUUIDNil             = errors.New("UUID is Nil")
 )
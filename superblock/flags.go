@@ -1,9 +1,14 @@
 package superblock
 
 const (
-
+	// FlagHamtIndex marks volumes keeping their index in a HAMT inside
+	// the volume instead of a separate bolt database
+	FlagHamtIndex = 1 << iota
+	// FlagClean is set when the volume is closed and cleared while it is
+	// open, volumes opened without it were not shut down cleanly
+	FlagClean
 	// insert flags here
-	lastFlag = 1 << iota
+	lastFlag
 )
 
 const (
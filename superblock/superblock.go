@@ -21,7 +21,7 @@ type Superblock struct {
 // The blk has to be BlockSize in size
 func OpenSuperblock(blk []byte) (*Superblock, error) {
 	if len(blk) != consts.BlockSize {
-		return nil, errBlockSizeDifferent
+		return nil, ErrBlockSizeDifferent
 	}
 
 	s := &Superblock{
@@ -15,7 +15,7 @@ func TestManualSuperblock(t *testing.T) {
 
 	s, err := OpenSuperblock(buf)
 
-	assert.EqualError(t, err, errMagicMissMatch.Error(),
+	assert.EqualError(t, err, ErrMagicMissMatch.Error(),
 		errMsgStart+"lack of magic bytes")
 	assert.Nil(t, s, "should be nil")
 
@@ -23,14 +23,14 @@ func TestManualSuperblock(t *testing.T) {
 	copy(buf[magicStart:magicEnd], []byte(magicBytes))
 	s, err = OpenSuperblock(buf)
 
-	assert.EqualError(t, err, errWrongVersion.Error(),
+	assert.EqualError(t, err, ErrWrongVersion.Error(),
 		errMsgStart+"wrong version")
 	assert.Nil(t, s, "should be nil")
 
 	binary.PutUint16(buf[versionStart:versionEnd], 1)
 	s, err = OpenSuperblock(buf)
 
-	assert.EqualError(t, err, errUUIDNil.Error(),
+	assert.EqualError(t, err, ErrUUIDNil.Error(),
 		errMsgStart+"nil UUID")
 	assert.Nil(t, s, "should be nil")
 
@@ -38,14 +38,14 @@ func TestManualSuperblock(t *testing.T) {
 	copy(buf[uuidStart:uuidEnd], u[:])
 	s, err = OpenSuperblock(buf)
 
-	assert.EqualError(t, err, errUUIDCopyMissMatch.Error(),
+	assert.EqualError(t, err, ErrUUIDCopyMissMatch.Error(),
 		errMsgStart+"UUID missmatch")
 	assert.Nil(t, s, "should be nil")
 
 	copy(buf[uuidCopyStart:uuidCopyEnd], u[:])
 	s, err = OpenSuperblock(buf)
 
-	assert.EqualError(t, err, errBlockSizeDifferent.Error(),
+	assert.EqualError(t, err, ErrBlockSizeDifferent.Error(),
 		errMsgStart+"blocksize missmatch")
 	assert.Nil(t, s, "should be nil")
 
@@ -66,7 +66,7 @@ func TestZeroBlockIsChecked(t *testing.T) {
 	for i := zero1Start; i < zero1End; i++ {
 		blk[i] = byte(5)
 		s, err = OpenSuperblock(blk)
-		assert.EqualError(t, err, errZeroPartIsNotZeroed.Error(), "should be detected")
+		assert.EqualError(t, err, ErrZeroPartIsNotZeroed.Error(), "should be detected")
 		assert.Nil(t, s, "Superblock should not be created")
 
 		blk[i] = byte(0)
@@ -75,7 +75,7 @@ func TestZeroBlockIsChecked(t *testing.T) {
 	for i := zero2Start; i < zero2End; i++ {
 		blk[i] = byte(5)
 		s, err = OpenSuperblock(blk)
-		assert.EqualError(t, err, errZeroPartIsNotZeroed.Error(), "should be detected")
+		assert.EqualError(t, err, ErrZeroPartIsNotZeroed.Error(), "should be detected")
 		assert.Nil(t, s, "Superblock should not be created")
 
 		blk[i] = byte(0)
@@ -87,7 +87,7 @@ func TestWrongLenghtIsDetected(t *testing.T) {
 		blk := make([]byte, i)
 
 		s, err := OpenSuperblock(blk)
-		assert.EqualError(t, err, errBlockSizeDifferent.Error(),
+		assert.EqualError(t, err, ErrBlockSizeDifferent.Error(),
 			"open with wrong size should fiail")
 		assert.Nil(t, s, "Superblock should not be created")
 	}
@@ -106,7 +106,7 @@ func TestReservedFlags(t *testing.T) {
 		w.SetFlags(uint16(badFlag))
 
 		s, err := OpenSuperblock(blk)
-		assert.EqualError(t, err, errFlagsReserved.Error(),
+		assert.EqualError(t, err, ErrFlagsReserved.Error(),
 			"open with wrong flag should fiail")
 		assert.Nil(t, s, "Superblock should not be created")
 
@@ -38,6 +38,21 @@ func (w *Writer) SetBlocksize(bsize uint32) {
 	binary.PutUint32(w.blk[blkSizeStart:blkSizeEnd], bsize)
 }
 
+// SetIndexRoot writes block index of the root of in-volume index
+func (w *Writer) SetIndexRoot(blk uint64) {
+	binary.PutUint64(w.blk[idxRootStart:idxRootEnd], blk)
+}
+
+// SetAllocatorCount writes number of allocators formatted in the volume
+func (w *Writer) SetAllocatorCount(n uint64) {
+	binary.PutUint64(w.blk[allocCntStart:allocCntEnd], n)
+}
+
+// SetCurrentAllocator writes number of the allocator blocks are allocated from
+func (w *Writer) SetCurrentAllocator(n uint64) {
+	binary.PutUint64(w.blk[curAllocStart:curAllocEnd], n)
+}
+
 func (w *Writer) ZeroOutZeros() {
 	s := w.blk[zero1Start:zero1End]
 	for i, _ := range s {
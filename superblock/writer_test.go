@@ -42,3 +42,35 @@ func TestWriterBlockSize(t *testing.T) {
 		assert.Equal(t, s, v, "version read is not the same as written")
 	}
 }
+
+func TestWriterIndexRoot(t *testing.T) {
+	blk, a, w := tSupBlk()
+	err := Format(blk)
+	assert.NoError(t, err, "Format should work")
+	assert.Zero(t, a.IndexRoot(), "new superblock has no index root")
+
+	w.SetIndexRoot(12345)
+	w.SetFlags(FlagHamtIndex)
+	assert.EqualValues(t, 12345, a.IndexRoot(), "index root read is not the same as written")
+
+	s, err := OpenSuperblock(blk)
+	assert.NoError(t, err, "superblock with index root should be valid")
+	assert.NotNil(t, s, "superblock should be valid")
+}
+
+func TestWriterAllocators(t *testing.T) {
+	blk, a, w := tSupBlk()
+	err := Format(blk)
+	assert.NoError(t, err, "Format should work")
+	assert.Zero(t, a.AllocatorCount(), "new superblock has no allocator count")
+	assert.Zero(t, a.CurrentAllocator(), "new superblock starts at first allocator")
+
+	w.SetAllocatorCount(7)
+	w.SetCurrentAllocator(5)
+	assert.EqualValues(t, 7, a.AllocatorCount(), "allocator count read is not the same as written")
+	assert.EqualValues(t, 5, a.CurrentAllocator(), "current allocator read is not the same as written")
+
+	s, err := OpenSuperblock(blk)
+	assert.NoError(t, err, "superblock with allocators should be valid")
+	assert.NotNil(t, s, "superblock should be valid")
+}
@@ -0,0 +1,124 @@
+package sbs
+
+import (
+	"os"
+
+	"github.com/ipfs/go-sbs/consts"
+	"github.com/ipfs/go-sbs/trie"
+
+	mmap "github.com/gxed/mmap-go"
+)
+
+// Sync makes all data written so far durable: the mapped data file is flushed
+// first, then the index.
+func (sbs *Sbs) Sync() error {
+	if err := sbs.flushMapping(); err != nil {
+		return err
+	}
+	return sbs.index.Sync()
+}
+
+// commit publishes records of values written before in an index transaction.
+// Depending on the sync mode blocks and allocators are flushed first so the
+// index never points to data that didn't make it to the disk.
+func (sbs *Sbs) commit(batch bool, fn func(tx indexTx) error) error {
+	switch {
+	case sbs.opts.Sync == SyncAlways:
+		if err := sbs.flushAllocators(); err != nil {
+			return err
+		}
+	case sbs.opts.Sync == SyncBatch && batch:
+		if err := sbs.flushMapping(); err != nil {
+			return err
+		}
+	}
+
+	if err := sbs.index.Update(fn); err != nil {
+		return err
+	}
+
+	if sbs.opts.Sync == SyncBatch && batch {
+		return sbs.index.Sync()
+	}
+	return nil
+}
+
+// syncExtents flushes blocks of exts if every write is synced
+func (sbs *Sbs) syncExtents(exts []extent) error {
+	if sbs.opts.Sync != SyncAlways {
+		return nil
+	}
+	return sbs.withLease(func() error {
+		mm := sbs.mapping()
+		for _, e := range exts {
+			err := flushRange(mm, e.start*consts.BlockSize, (e.start+e.length)*consts.BlockSize)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// syncTrie flushes blocks of the trie if every write is synced
+func (sbs *Sbs) syncTrie(root uint64) error {
+	if sbs.opts.Sync != SyncAlways {
+		return nil
+	}
+
+	var exts []extent
+	err := sbs.withLease(func() error {
+		return trie.Blocks(volumeStorage{sbs}, root, func(blk uint64) error {
+			exts = append(exts, extent{blk, 1})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return sbs.syncExtents(exts)
+}
+
+// markDirty remembers that n-th allocator has to be flushed, allocLk must
+// be held
+func (sbs *Sbs) markDirty(n uint64) {
+	if sbs.dirtyAllocs == nil {
+		sbs.dirtyAllocs = make(map[uint64]struct{})
+	}
+	sbs.dirtyAllocs[n] = struct{}{}
+}
+
+// flushAllocators flushes allocators modified since the last flush
+func (sbs *Sbs) flushAllocators() error {
+	sbs.allocLk.Lock()
+	defer sbs.allocLk.Unlock()
+
+	for n := range sbs.dirtyAllocs {
+		beg := allocatorStart(n) * consts.BlockSize
+		if err := flushRange(sbs.mm, beg, beg+consts.BlockSize); err != nil {
+			return err
+		}
+		delete(sbs.dirtyAllocs, n)
+	}
+	return nil
+}
+
+// flushMapping flushes the whole mapped data file, allocators included
+func (sbs *Sbs) flushMapping() error {
+	sbs.allocLk.Lock()
+	sbs.dirtyAllocs = nil
+	sbs.allocLk.Unlock()
+
+	return sbs.withLease(func() error {
+		return sbs.mapping().Flush()
+	})
+}
+
+var pageSize = uint64(os.Getpagesize())
+
+// flushRange flushes bytes beg to end of the mapping, msync needs beginning
+// aligned to the page size
+func flushRange(mm mmap.MMap, beg, end uint64) error {
+	beg -= beg % pageSize
+	return mm[beg:end].Flush()
+}
@@ -0,0 +1,89 @@
+package sbs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-sbs/consts"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestSyncModes(t *testing.T) {
+	for _, mode := range []SyncMode{SyncAlways, SyncBatch, SyncNone} {
+		dir := sbsDir(t)
+		defer os.RemoveAll(dir)
+
+		opts := DefaultOptions
+		opts.Sync = mode
+		sbs, err := OpenWithOptions(dir, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if noSync := sbs.index.(*boltIndex).db.NoSync; noSync != (mode != SyncAlways) {
+			t.Fatalf("mode %d: bolt NoSync is %t", mode, noSync)
+		}
+
+		vals := make(map[string][]byte)
+		for i := 0; i < 20; i++ {
+			k := fmt.Sprintf("/key-%d", i)
+			vals[k] = testValue(int64(i), i*consts.BlockSize/3)
+			if err := sbs.Put([]byte(k), vals[k]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if mode == SyncAlways && len(sbs.dirtyAllocs) != 0 {
+			t.Fatal("allocators should be flushed with each value")
+		}
+		if mode != SyncAlways && len(sbs.dirtyAllocs) == 0 {
+			t.Fatal("allocators should not be flushed with each value")
+		}
+
+		fs := &Sbsds{sbs: sbs}
+		b, err := fs.Batch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals["/batched"] = testValue(100, 2*consts.BlockSize)
+		if err := b.Put(ds.NewKey("/batched"), vals["/batched"]); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if mode == SyncBatch && len(sbs.dirtyAllocs) != 0 {
+			t.Fatal("batch commit should flush allocators")
+		}
+
+		if err := sbs.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if len(sbs.dirtyAllocs) != 0 {
+			t.Fatal("Sync should flush allocators")
+		}
+		if err := sbs.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		sbs, err = OpenWithOptions(dir, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range vals {
+			out, err := sbs.Get([]byte(k))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, v) {
+				t.Fatalf("mode %d: value of %s differs", mode, k)
+			}
+		}
+		if err := sbs.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
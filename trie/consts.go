@@ -0,0 +1,33 @@
+package trie
+
+import (
+	"github.com/ipfs/go-sbs/consts"
+)
+
+// trie block layout
+const (
+	versionStart = 0
+	versionEnd   = versionStart + 1
+	levelStart   = versionEnd
+	levelEnd     = levelStart + 1
+	countStart   = levelEnd
+	countEnd     = countStart + 2
+	headerEnd    = 16
+	entriesStart = headerEnd
+)
+
+// entry layout
+const (
+	entryStartStart  = 0
+	entryStartEnd    = entryStartStart + 8
+	entryLengthStart = entryStartEnd
+	entryLengthEnd   = entryLengthStart + 8
+	entrySize        = entryLengthEnd
+)
+
+const (
+	blockVersion = 1
+
+	// EntriesPerBlock is number of extents a single trie block references
+	EntriesPerBlock = (consts.BlockSize - headerEnd) / entrySize
+)
@@ -0,0 +1,11 @@
+package trie
+
+import (
+	errors "github.com/juju/errors"
+)
+
+var (
+	ErrWrongVersion = errors.New("trie block version is not 1")
+	ErrWrongLevel   = errors.New("trie block is on unexpected level")
+	ErrNoExtents    = errors.New("trie needs at least one extent")
+)
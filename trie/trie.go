@@ -0,0 +1,185 @@
+package trie
+
+import (
+	binenc "encoding/binary"
+
+	"github.com/ipfs/go-sbs/storage"
+
+	errors "github.com/juju/errors"
+)
+
+var (
+	binary binenc.ByteOrder = binenc.LittleEndian
+)
+
+// Extent is a run of Length consecutive blocks starting at Start
+type Extent struct {
+	Start  uint64
+	Length uint64
+}
+
+// A block trie lists extents of a value in 8k blocks. Entries of blocks on
+// level 0 are extents of the value, entries of blocks on higher levels point
+// to a trie block one level lower (Start) and hold number of value blocks
+// below it (Length), so any offset can be reached without reading the blocks
+// before it.
+
+// Build writes trie listing exts and returns block index of its root
+func Build(s storage.Storage, exts []Extent) (uint64, error) {
+	if len(exts) == 0 {
+		return 0, errors.Trace(ErrNoExtents)
+	}
+
+	var written []uint64
+	level := uint8(0)
+	for {
+		var parents []Extent
+		for beg := 0; beg < len(exts); beg += EntriesPerBlock {
+			end := beg + EntriesPerBlock
+			if end > len(exts) {
+				end = len(exts)
+			}
+
+			blk, err := s.Allocate(1)
+			if err != nil {
+				free(s, written)
+				return 0, errors.Trace(err)
+			}
+			written = append(written, blk)
+			writeBlock(s.Block(blk), level, exts[beg:end])
+
+			var length uint64
+			for _, e := range exts[beg:end] {
+				length += e.Length
+			}
+			parents = append(parents, Extent{blk, length})
+		}
+
+		if len(parents) == 1 {
+			return parents[0].Start, nil
+		}
+		exts = parents
+		level++
+	}
+}
+
+func free(s storage.Storage, blks []uint64) {
+	for _, blk := range blks {
+		s.Free(blk, 1)
+	}
+}
+
+func writeBlock(blk []byte, level uint8, exts []Extent) {
+	for i := range blk {
+		blk[i] = 0
+	}
+	blk[versionStart] = blockVersion
+	blk[levelStart] = level
+	binary.PutUint16(blk[countStart:countEnd], uint16(len(exts)))
+
+	for i, e := range exts {
+		ent := blk[entriesStart+i*entrySize:]
+		binary.PutUint64(ent[entryStartStart:entryStartEnd], e.Start)
+		binary.PutUint64(ent[entryLengthStart:entryLengthEnd], e.Length)
+	}
+}
+
+// readBlock returns level and entries of trie block n
+func readBlock(s storage.Storage, n uint64) (uint8, []Extent, error) {
+	if err := s.Check(n, 1); err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	blk := s.Block(n)
+	if blk[versionStart] != blockVersion {
+		return 0, nil, errors.Trace(ErrWrongVersion)
+	}
+
+	count := int(binary.Uint16(blk[countStart:countEnd]))
+	if count > EntriesPerBlock {
+		count = EntriesPerBlock
+	}
+	exts := make([]Extent, count)
+	for i := range exts {
+		ent := blk[entriesStart+i*entrySize:]
+		exts[i].Start = binary.Uint64(ent[entryStartStart:entryStartEnd])
+		exts[i].Length = binary.Uint64(ent[entryLengthStart:entryLengthEnd])
+	}
+	return blk[levelStart], exts, nil
+}
+
+// ForEach calls fn for extents of the trie with root in block root in order,
+// skipping first blocks of the value. Iteration stops at first error returned
+// by fn.
+func ForEach(s storage.Storage, root uint64, first uint64, fn func(e Extent) error) error {
+	level, exts, err := readBlock(s, root)
+	if err != nil {
+		return err
+	}
+	_, err = forEach(s, level, exts, first, fn)
+	return err
+}
+
+func forEach(s storage.Storage, level uint8, exts []Extent, first uint64, fn func(e Extent) error) (uint64, error) {
+	for _, e := range exts {
+		if first >= e.Length {
+			first -= e.Length
+			continue
+		}
+
+		if level == 0 {
+			if err := fn(Extent{e.Start + first, e.Length - first}); err != nil {
+				return 0, err
+			}
+			first = 0
+			continue
+		}
+
+		clevel, cexts, err := readBlock(s, e.Start)
+		if err != nil {
+			return 0, err
+		}
+		if clevel != level-1 {
+			return 0, errors.Trace(ErrWrongLevel)
+		}
+		first, err = forEach(s, clevel, cexts, first, fn)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return first, nil
+}
+
+// Blocks calls fn for every block of the trie itself, children are visited
+// before their parent
+func Blocks(s storage.Storage, root uint64, fn func(blk uint64) error) error {
+	level, exts, err := readBlock(s, root)
+	if err != nil {
+		return err
+	}
+	return blocks(s, root, level, exts, fn)
+}
+
+func blocks(s storage.Storage, n uint64, level uint8, exts []Extent, fn func(blk uint64) error) error {
+	if level > 0 {
+		for _, e := range exts {
+			clevel, cexts, err := readBlock(s, e.Start)
+			if err != nil {
+				return err
+			}
+			if clevel != level-1 {
+				return errors.Trace(ErrWrongLevel)
+			}
+			if err := blocks(s, e.Start, clevel, cexts, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return fn(n)
+}
+
+// Free releases blocks of the trie, blocks of the value are not freed
+func Free(s storage.Storage, root uint64) error {
+	return Blocks(s, root, func(blk uint64) error {
+		return s.Free(blk, 1)
+	})
+}
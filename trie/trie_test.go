@@ -0,0 +1,133 @@
+package trie
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-sbs/internal/storagetest"
+	"github.com/ipfs/go-sbs/storage"
+
+	errors "github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func tExtents(n int) []Extent {
+	exts := make([]Extent, n)
+	for i := range exts {
+		exts[i] = Extent{uint64(1000000 + 10*i), uint64(1 + i%7)}
+	}
+	return exts
+}
+
+func collect(t *testing.T, s storage.Storage, root, first uint64) []Extent {
+	var exts []Extent
+	err := ForEach(s, root, first, func(e Extent) error {
+		exts = append(exts, e)
+		return nil
+	})
+	assert.NoError(t, err)
+	return exts
+}
+
+func TestBuildSingleBlock(t *testing.T) {
+	s := storagetest.NewMem()
+	exts := tExtents(10)
+
+	root, err := Build(s, exts)
+	assert.NoError(t, err)
+	assert.Len(t, s.Blks, 1)
+	assert.Equal(t, exts, collect(t, s, root, 0))
+}
+
+func TestBuildLevels(t *testing.T) {
+	for _, n := range []int{EntriesPerBlock, EntriesPerBlock + 1, EntriesPerBlock*EntriesPerBlock + 3} {
+		s := storagetest.NewMem()
+		exts := tExtents(n)
+
+		root, err := Build(s, exts)
+		assert.NoError(t, err)
+		assert.Equal(t, exts, collect(t, s, root, 0), "extents differ for %d", n)
+
+		var blks int
+		err = Blocks(s, root, func(blk uint64) error {
+			blks++
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, len(s.Blks), blks)
+
+		assert.NoError(t, Free(s, root))
+		assert.Len(t, s.Freed, len(s.Blks))
+	}
+}
+
+func TestForEachFrom(t *testing.T) {
+	s := storagetest.NewMem()
+	exts := tExtents(3 * EntriesPerBlock)
+
+	root, err := Build(s, exts)
+	assert.NoError(t, err)
+
+	var total uint64
+	for _, e := range exts {
+		total += e.Length
+	}
+
+	for _, first := range []uint64{0, 1, 5, 2000, total - 1} {
+		var skip uint64
+		var expected []Extent
+		for _, e := range exts {
+			if skip+e.Length <= first {
+				skip += e.Length
+				continue
+			}
+			if skip < first {
+				e = Extent{e.Start + first - skip, e.Length - (first - skip)}
+				skip = first
+			}
+			expected = append(expected, e)
+		}
+		assert.Equal(t, expected, collect(t, s, root, first), "from %d", first)
+	}
+
+	assert.Empty(t, collect(t, s, root, total))
+}
+
+func TestBuildEmpty(t *testing.T) {
+	_, err := Build(storagetest.NewMem(), nil)
+	assert.Equal(t, ErrNoExtents, errors.Cause(err))
+}
+
+func TestWrongVersion(t *testing.T) {
+	s := storagetest.NewMem()
+	root, err := Build(s, tExtents(2))
+	assert.NoError(t, err)
+
+	s.Blks[root][versionStart] = 2
+	err = ForEach(s, root, 0, func(e Extent) error { return nil })
+	assert.Equal(t, ErrWrongVersion, errors.Cause(err))
+}
+
+func TestRootOutsideStorage(t *testing.T) {
+	s := storagetest.NewMem()
+	_, err := Build(s, tExtents(2))
+	assert.NoError(t, err)
+
+	root := uint64(len(s.Blks)) + 5
+	err = ForEach(s, root, 0, func(e Extent) error { return nil })
+	assert.Error(t, err)
+	err = Blocks(s, root, func(blk uint64) error { return nil })
+	assert.Error(t, err)
+}
+
+func TestSelfReference(t *testing.T) {
+	s := storagetest.NewMem()
+	root, err := Build(s, tExtents(EntriesPerBlock+1))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, s.Blks[root][levelStart])
+
+	binary.PutUint64(s.Blks[root][entriesStart+entryStartStart:], root)
+	err = ForEach(s, root, 0, func(e Extent) error { return nil })
+	assert.Equal(t, ErrWrongLevel, errors.Cause(err))
+	err = Blocks(s, root, func(blk uint64) error { return nil })
+	assert.Equal(t, ErrWrongLevel, errors.Cause(err))
+}
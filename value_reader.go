@@ -0,0 +1,152 @@
+package sbs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-sbs/consts"
+	pb "github.com/ipfs/go-sbs/pb"
+
+	proto "github.com/gogo/protobuf/proto"
+)
+
+// ValueReader reads a value directly from blocks of the volume
+type ValueReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+
+	// Size returns size of the value in bytes
+	Size() int64
+}
+
+// Open returns reader of value stored under k. Reads after the value was
+// deleted or replaced fail with ErrNotFound. Reads are not verified against
+// the checksum of the value, use Get or View for that.
+func (sbs *Sbs) Open(k []byte) (ValueReader, error) {
+	var rec []byte
+	err := sbs.index.View(func(tx indexTx) error {
+		rec = append([]byte{}, tx.Get(k)...)
+		if len(rec) == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var prec pb.Record
+	if err := proto.Unmarshal(rec, &prec); err != nil {
+		return nil, err
+	}
+	return &valueReader{
+		sbs:  sbs,
+		k:    append([]byte{}, k...),
+		rec:  rec,
+		prec: &prec,
+		size: int64(prec.GetSize_()),
+	}, nil
+}
+
+type valueReader struct {
+	sbs *Sbs
+	k   []byte
+	// rec is the record the reader was opened with
+	rec  []byte
+	prec *pb.Record
+	size int64
+	off  int64
+}
+
+// check returns ErrNotFound if the record of the value changed since Open.
+// Called with a lease held it keeps blocks of the value from being reused
+// until the lease is released.
+func (vr *valueReader) check() error {
+	return vr.sbs.index.View(func(tx indexTx) error {
+		if !bytes.Equal(tx.Get(vr.k), vr.rec) {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (vr *valueReader) Size() int64 {
+	return vr.size
+}
+
+func (vr *valueReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+	if off >= vr.size {
+		return 0, io.EOF
+	}
+
+	var eof error
+	if left := vr.size - off; int64(len(p)) > left {
+		p = p[:left]
+		eof = io.EOF
+	}
+
+	if vr.prec.GetType() == pb.Record_Direct {
+		if err := vr.check(); err != nil {
+			return 0, err
+		}
+		n := copy(p, vr.prec.GetData()[off:])
+		return n, eof
+	}
+
+	n := 0
+	err := vr.sbs.withLease(func() error {
+		if err := vr.check(); err != nil {
+			return err
+		}
+
+		mm := vr.sbs.mapping()
+		skip := uint64(off) % consts.BlockSize
+		return vr.sbs.walkExtents(vr.prec, uint64(off)/consts.BlockSize, func(e extent) error {
+			beg := e.start*consts.BlockSize + skip
+			end := (e.start + e.length) * consts.BlockSize
+			skip = 0
+
+			n += copy(p[n:], mm[beg:end])
+			if n == len(p) {
+				return errStopIteration
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, eof
+}
+
+func (vr *valueReader) Read(p []byte) (int, error) {
+	n, err := vr.ReadAt(p, vr.off)
+	vr.off += int64(n)
+	if err == io.EOF && n > 0 {
+		// io.Reader reports EOF on the next call
+		err = nil
+	}
+	return n, err
+}
+
+func (vr *valueReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += vr.off
+	case io.SeekEnd:
+		offset += vr.size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	vr.off = offset
+	return offset, nil
+}
@@ -0,0 +1,133 @@
+package sbs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-sbs/consts"
+)
+
+func TestValueReader(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	sizes := []int{0, 100, consts.BlockSize, 5*consts.BlockSize + 17}
+	for i, size := range sizes {
+		v := testValue(int64(i), size)
+		k := []byte(fmt.Sprintf("value-%d", size))
+		if err := sbs.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+
+		vr, err := sbs.Open(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vr.Size() != int64(size) {
+			t.Fatalf("size %d, expected %d", vr.Size(), size)
+		}
+
+		out, err := ioutil.ReadAll(vr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, v) {
+			t.Fatalf("value of %s differs", k)
+		}
+
+		for _, off := range []int{0, 1, consts.BlockSize - 1, consts.BlockSize, 3*consts.BlockSize + 5} {
+			if off > size {
+				continue
+			}
+			for _, l := range []int{1, 50, consts.BlockSize + 3, size} {
+				buf := make([]byte, l)
+				n, err := vr.ReadAt(buf, int64(off))
+
+				expected := v[off:]
+				if len(expected) > l {
+					expected = expected[:l]
+				}
+				if n < l && err != io.EOF {
+					t.Fatalf("short read should return io.EOF, got: %v", err)
+				}
+				if n == l && err != nil && err != io.EOF {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf[:n], expected) {
+					t.Fatalf("ReadAt(%d, %d) of %s differs", l, off, k)
+				}
+			}
+		}
+
+		pos, err := vr.Seek(-int64(size/2), io.SeekEnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err = ioutil.ReadAll(vr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, v[pos:]) {
+			t.Fatalf("read after seek of %s differs", k)
+		}
+	}
+
+	if _, err := sbs.Open([]byte("missing")); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got: %v", err)
+	}
+}
+
+func TestValueReaderReplaced(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	for i, size := range []int{100, 3 * consts.BlockSize} {
+		k := []byte(fmt.Sprintf("value-%d", size))
+		v := testValue(int64(i), size)
+		if err := sbs.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+		vr, err := sbs.Open(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// blocks of the old value are reused by the new one
+		if err := sbs.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+		if err := sbs.Put(k, testValue(int64(i+10), size)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vr.ReadAt(make([]byte, 10), 0); err != ErrNotFound {
+			t.Fatalf("expected ErrNotFound after replace, got: %v", err)
+		}
+
+		vr, err = sbs.Open(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sbs.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vr.Read(make([]byte, 10)); err != ErrNotFound {
+			t.Fatalf("expected ErrNotFound after delete, got: %v", err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package sbs
+
+import (
+	"github.com/ipfs/go-sbs/consts"
+	pb "github.com/ipfs/go-sbs/pb"
+)
+
+// View calls fn with value stored under k. Values stored in a single extent
+// are passed directly from the mapped data file without copying, others are
+// copied first. val is valid only until fn returns and must not be modified.
+// The value is verified against its checksum before fn is called.
+//
+// While fn runs a lease on mapped memory is held: expanding the volume
+// doesn't unmap the memory and blocks of deleted or relocated values are not
+// freed (and so can't be reused) until the lease is released.
+func (sbs *Sbs) View(k []byte, fn func(val []byte) error) error {
+	return sbs.withLease(func() error {
+		return sbs.view(k, fn)
+	})
+}
+
+func (sbs *Sbs) view(k []byte, fn func(val []byte) error) error {
+	prec, err := sbs.getPB(k)
+	if err != nil {
+		return err
+	}
+
+	switch prec.GetType() {
+	case pb.Record_Direct:
+		if err := sbs.verify(k, prec, prec.GetData()); err != nil {
+			return err
+		}
+		return fn(prec.GetData())
+	case pb.Record_Indirect:
+		if exts := recordExtents(prec); len(exts) == 1 {
+			if err := sbs.checkExtent(exts[0]); err != nil {
+				return err
+			}
+			if prec.GetSize_() > exts[0].length*consts.BlockSize {
+				return &extentError{exts[0], "shorter than the value"}
+			}
+			off := exts[0].start * consts.BlockSize
+			val := sbs.mapping()[off : off+prec.GetSize_()]
+			if err := sbs.verify(k, prec, val); err != nil {
+				return err
+			}
+			return fn(val)
+		}
+	}
+
+	val := make([]byte, prec.GetSize_())
+	if err := sbs.read(k, prec, val); err != nil {
+		return err
+	}
+	return fn(val)
+}
@@ -0,0 +1,156 @@
+package sbs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-sbs/consts"
+)
+
+func TestView(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	vals := map[string][]byte{
+		"direct":  testValue(1, 10),
+		"extent":  testValue(2, 3*consts.BlockSize+7),
+		"empty":   {},
+		"extents": testValue(3, 4*consts.BlockSize),
+	}
+	for _, k := range []string{"direct", "extent", "empty"} {
+		if err := sbs.Put([]byte(k), vals[k]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// fill a hole and the tip so the value is split
+	if err := sbs.Put([]byte("hole"), testValue(4, consts.BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sbs.Put([]byte("after"), testValue(5, consts.BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sbs.Delete([]byte("hole")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sbs.Put([]byte("extents"), vals["extents"]); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range vals {
+		err := sbs.View([]byte(k), func(val []byte) error {
+			if !bytes.Equal(val, v) {
+				t.Fatalf("value of %s differs", k)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prec, err := sbs.getPB([]byte("extent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := recordExtents(prec)[0].start * consts.BlockSize
+	err = sbs.View([]byte("extent"), func(val []byte) error {
+		if &val[0] != &sbs.mm[off] {
+			t.Fatal("single extent value should not be copied")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sbs.View([]byte("missing"), nil); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got: %v", err)
+	}
+}
+
+func TestViewLease(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	v := testValue(1, 2*consts.BlockSize)
+	if err := sbs.Put([]byte("leased"), v); err != nil {
+		t.Fatal(err)
+	}
+
+	inUse := sbs.curAlloc.InUse()
+	err = sbs.View([]byte("leased"), func(val []byte) error {
+		if err := sbs.Delete([]byte("leased")); err != nil {
+			t.Fatal(err)
+		}
+		if sbs.curAlloc.InUse() != inUse {
+			t.Fatal("blocks of leased value were freed")
+		}
+
+		// would reuse the blocks if they were freed
+		if err := sbs.Put([]byte("other"), testValue(2, len(v))); err != nil {
+			t.Fatal(err)
+		}
+		if err := sbs.expand(allocatorEnd(1)); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(val, v) {
+			t.Fatal("leased value changed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sbs.curAlloc.InUse() != inUse {
+		t.Fatal("blocks of deleted value were not freed after the lease")
+	}
+	if len(sbs.leases.retired) != 0 {
+		t.Fatal("old mapping was not unmapped after the lease")
+	}
+}
+
+func TestViewPanicReleasesLease(t *testing.T) {
+	dir := sbsDir(t)
+	defer os.RemoveAll(dir)
+
+	sbs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sbs.Close()
+
+	if err := sbs.Put([]byte("leased"), testValue(1, 2*consts.BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic was not passed on")
+			}
+		}()
+		sbs.View([]byte("leased"), func(val []byte) error {
+			panic("view")
+		})
+	}()
+
+	if len(sbs.leases.active) != 0 {
+		t.Fatal("lease was not released after panic")
+	}
+}